@@ -5,10 +5,17 @@ import (
 	"LetsGoTroet/irc"
 	"LetsGoTroet/mastodon"
 	"database/sql"
+	"fmt"
 	"github.com/joho/godotenv"
 	_ "github.com/mattn/go-sqlite3"
 	"log"
+	"net/http"
 	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
 )
 
 const SQLITE_FILENAME = "messages.db"
@@ -21,16 +28,24 @@ func main() {
 
 	// Get variables from environment
 	irchost := os.Getenv("IRC_HOST")
+	if irchost == "" {
+		irchost = "irc.hackint.org:6697"
+	}
 	channel := os.Getenv("IRC_CHANNEL")
 	nick := os.Getenv("IRC_NICK")
 	nick_pw := os.Getenv("IRC_NICKPASS")
+	dm_target := os.Getenv("IRC_DM_TARGET")
+	moderation_channel := os.Getenv("IRC_MODERATION_CHANNEL")
 
-	baseurl := os.Getenv("MASTODON_BASEURL")
-	username := os.Getenv("MASTODON_USERNAME")
-	password := os.Getenv("MASTODON_PASSWORD")
-	id := os.Getenv("MASTODON_ID")
-	secret := os.Getenv("MASTODON_SECRET")
-	access_token := os.Getenv("MASTODON_ACCESS_TOKEN")
+	alias := os.Getenv("MASTODON_ALIAS")
+	if alias == "" {
+		alias = "main"
+	}
+	// Additional accounts are configured like the default one, with their alias in the variable names
+	var extra_accounts []string
+	if accounts := os.Getenv("MASTODON_ACCOUNTS"); accounts != "" {
+		extra_accounts = strings.Split(accounts, ",")
+	}
 
 	// Setup database
 	db := setupDB(SQLITE_FILENAME)
@@ -44,17 +59,202 @@ func main() {
 	if len(nick_pw) > 0 {
 		bot.SetPassword(nick_pw)
 	}
+	if alternates := os.Getenv("IRC_ALT_NICKS"); alternates != "" {
+		bot.SetAlternateNicks(strings.Split(alternates, ","))
+	}
+	if err = setupConnection(bot); err != nil {
+		log.Println(err)
+		return
+	}
+	if cert := os.Getenv("IRC_CLIENT_CERT"); cert != "" {
+		if err = bot.SetClientCertificate(cert, os.Getenv("IRC_CLIENT_KEY")); err != nil {
+			log.Println(err)
+			return
+		}
+	}
+	// SASL PLAIN is used whenever there is a password, unless disabled
+	sasl := os.Getenv("IRC_SASL")
+	if sasl == "" && len(nick_pw) > 0 {
+		sasl = irc.SASL_PLAIN
+	}
+	if sasl != "" && sasl != "none" {
+		if err = bot.SetSASL(sasl, os.Getenv("IRC_SASL_ACCOUNT")); err != nil {
+			log.Println(err)
+			return
+		}
+	}
+	if strings.HasPrefix(dm_target, "#") {
+		bot.AddChannel(dm_target)
+	}
+	if moderation_channel != "" {
+		bot.AddChannel(moderation_channel)
+	}
 	// Setup Mastodon adapter
-	mst, err := mastodon.New(baseurl, id, secret, access_token, username, password, db)
+	client, err := mastodon.NewHTTPClient(os.Getenv("MASTODON_CA_FILE"), os.Getenv("MASTODON_INSECURE") == "true")
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	if os.Getenv("MASTODON_INSECURE") == "true" {
+		log.Println("WARNING: TLS certificates of Mastodon instances are not verified (MASTODON_INSECURE)")
+	}
+	mst, err := setupMastodon("MASTODON", db, client)
 	if err != nil {
 		log.Println(err)
 		return
 	}
 	// Run service
-	service := app.New(bot, mst)
+	service, err := app.New(bot, mst, alias, db)
+	if err != nil {
+		log.Println("App creation failed:", err)
+		return
+	}
+	for _, extra := range extra_accounts {
+		extra = strings.TrimSpace(extra)
+		mst, err := setupMastodon("MASTODON_"+strings.ToUpper(extra), db, client)
+		if err != nil {
+			log.Println("Mastodon account", extra, "failed:", err)
+			return
+		}
+		if err = service.AddAccount(extra, mst); err != nil {
+			log.Println(err)
+			return
+		}
+	}
+	service.SetDirectTarget(dm_target)
+	service.SetModerationChannel(moderation_channel)
+	if window := os.Getenv("NOTIFICATION_WINDOW"); window != "" {
+		duration, err := time.ParseDuration(window)
+		if err != nil {
+			log.Println("Invalid NOTIFICATION_WINDOW:", err)
+			return
+		}
+		service.SetAggregationWindow(duration)
+	}
+	digest_types := []string{"favourite", "reblog"}
+	if types := os.Getenv("NOTIFICATION_DIGEST_TYPES"); types != "" {
+		digest_types = strings.Split(types, ",")
+	}
+	var quiet_types []string
+	if types := os.Getenv("QUIET_TYPES"); types != "" {
+		quiet_types = strings.Split(types, ",")
+	}
+	if err = service.SetQuietHours(os.Getenv("QUIET_HOURS"), quiet_types, os.Getenv("QUIET_MENTIONS") == "true"); err != nil {
+		log.Println("Invalid QUIET_HOURS:", err)
+		return
+	}
+	switch os.Getenv("NOTIFICATION_DIGEST") {
+	case "hourly":
+		err = service.SetDigest(time.Hour, digest_types)
+	case "daily":
+		err = service.SetDigest(24*time.Hour, digest_types)
+	case "":
+	default:
+		log.Println("Invalid NOTIFICATION_DIGEST, use hourly or daily")
+		return
+	}
+	if err != nil {
+		log.Println("Invalid NOTIFICATION_DIGEST_TYPES:", err)
+		return
+	}
+	if link_secret := os.Getenv("LINK_SECRET"); link_secret != "" {
+		if err = service.SetLinker(mastodon.NewLinker(db), link_secret); err != nil {
+			log.Println("Linking personal accounts disabled:", err)
+		}
+	}
+	// Leave IRC properly when stopped
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-signals
+		log.Println("Shutting down")
+		bot.Quit("Shutting down")
+		db.Close()
+		os.Exit(0)
+	}()
 	service.Run()
 }
 
+// Configures how the IRC client connects: plaintext, CA or pinned certificate, SOCKS5 proxy and address family,
+// as well as the pacing of the output
+func setupConnection(bot *irc.IrcClient) error {
+	bot.SetPlaintext(os.Getenv("IRC_PLAINTEXT") == "true")
+	if ca := os.Getenv("IRC_CA_FILE"); ca != "" {
+		if err := bot.SetCA(ca); err != nil {
+			return err
+		}
+	}
+	if fingerprint := os.Getenv("IRC_FINGERPRINT"); fingerprint != "" {
+		if err := bot.PinCertificate(fingerprint); err != nil {
+			return err
+		}
+	}
+	if err := bot.SetProxy(os.Getenv("IRC_PROXY")); err != nil {
+		return err
+	}
+	if err := bot.SetAddressFamily(os.Getenv("IRC_ADDRESS_FAMILY")); err != nil {
+		return err
+	}
+	// Flood control and pagination keep their defaults unless configured
+	burst, interval := irc.FLOOD_BURST, irc.FLOOD_INTERVAL
+	if value := os.Getenv("IRC_FLOOD_BURST"); value != "" {
+		parsed, err := strconv.Atoi(value)
+		if err != nil {
+			return fmt.Errorf("Invalid IRC_FLOOD_BURST: %w", err)
+		}
+		burst = parsed
+	}
+	if value := os.Getenv("IRC_FLOOD_INTERVAL"); value != "" {
+		parsed, err := time.ParseDuration(value)
+		if err != nil {
+			return fmt.Errorf("Invalid IRC_FLOOD_INTERVAL: %w", err)
+		}
+		interval = parsed
+	}
+	bot.SetFloodControl(burst, interval)
+	if value := os.Getenv("IRC_PAGE_LINES"); value != "" {
+		lines, err := strconv.Atoi(value)
+		if err != nil {
+			return fmt.Errorf("Invalid IRC_PAGE_LINES: %w", err)
+		}
+		bot.SetPageLength(lines)
+	}
+	ping, timeout := irc.PING_INTERVAL, irc.PING_TIMEOUT
+	if value := os.Getenv("IRC_PING_INTERVAL"); value != "" {
+		parsed, err := time.ParseDuration(value)
+		if err != nil {
+			return fmt.Errorf("Invalid IRC_PING_INTERVAL: %w", err)
+		}
+		ping = parsed
+	}
+	if value := os.Getenv("IRC_PING_TIMEOUT"); value != "" {
+		parsed, err := time.ParseDuration(value)
+		if err != nil {
+			return fmt.Errorf("Invalid IRC_PING_TIMEOUT: %w", err)
+		}
+		timeout = parsed
+	}
+	bot.SetKeepalive(ping, timeout)
+	return nil
+}
+
+// Creates a Mastodon adapter from the variables starting with prefix (e.g. MASTODON_BASEURL for prefix MASTODON)
+func setupMastodon(prefix string, db *sql.DB, client *http.Client) (*mastodon.MastodonClient, error) {
+	baseurl := os.Getenv(prefix + "_BASEURL")
+	username := os.Getenv(prefix + "_USERNAME")
+	password := os.Getenv(prefix + "_PASSWORD")
+	id := os.Getenv(prefix + "_ID")
+	secret := os.Getenv(prefix + "_SECRET")
+	access_token := os.Getenv(prefix + "_ACCESS_TOKEN")
+	mst, err := mastodon.New(baseurl, id, secret, access_token, username, password, db, client)
+	if err != nil {
+		return nil, err
+	}
+	// Relaying dismisses the notifications on the server, so it has to be asked for
+	mst.SetNotificationRelay(os.Getenv(prefix+"_NOTIFICATIONS") == "true")
+	return mst, nil
+}
+
 func setupDB(filename string) *sql.DB {
 	db, err := sql.Open("sqlite3", filename)
 	if err != nil {
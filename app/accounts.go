@@ -0,0 +1,157 @@
+package app
+
+import (
+	"fmt"
+	"log"
+	"strings"
+)
+
+// Separates the command name from the alias of the account to use, as in ".t@events"
+const account_selector = "@"
+
+// A command called from IRC
+type invocation struct {
+	msgtype string
+	// Everything after the command name
+	args string
+	// The account alias selected with the command, empty if none was given
+	account   string
+	messageID string
+}
+
+// Splits a message into the command and its arguments. The command name may carry an account selector.
+// Returns false if the message does not call a known command (or lacks arguments the command needs).
+func parseInvocation(commands map[string]command, msgtype string, message string, messageID string) (invocation, command, bool) {
+	if !strings.HasPrefix(message, command_prefix) {
+		return invocation{}, command{}, false
+	}
+	name, args, _ := strings.Cut(strings.TrimPrefix(message, command_prefix), " ")
+	name, account, _ := strings.Cut(name, account_selector)
+	cmd, ok := commands[name]
+	if !ok {
+		return invocation{}, command{}, false
+	}
+	args = strings.TrimSpace(args)
+	if cmd.nargs > 0 && args == "" {
+		return invocation{}, command{}, false
+	}
+	return invocation{
+		msgtype:   msgtype,
+		args:      args,
+		account:   strings.ToLower(account),
+		messageID: messageID,
+	}, cmd, true
+}
+
+// Adds a Mastodon account under an alias. Needs to be called before Run.
+func (app *App) AddAccount(alias string, social SocialAdapter) error {
+	alias = strings.ToLower(alias)
+	if _, exists := app.accounts[alias]; exists {
+		return fmt.Errorf("An account with alias %s already exists", alias)
+	}
+	if strings.ContainsAny(alias, " "+account_selector) || alias == "" || alias == personal_account {
+		return fmt.Errorf("Invalid account alias '%s'", alias)
+	}
+	app.accounts[alias] = social
+	app.aliases = append(app.aliases, alias)
+	social.RegisterMessageHandler(func(msgtype string, message string, messageID string) {
+		app.handleMastodonMessage(alias, msgtype, message, messageID)
+	})
+	return nil
+}
+
+// Operators may call every command. Everybody else only those without elevated permissions
+// and, since it only affects their own account, personal commands acting as their linked account.
+func (call invocation) permitted(cmd command) bool {
+	return !cmd.elevated_permissions || strings.HasSuffix(call.msgtype, ".op") || cmd.personal && call.account == personal_account
+}
+
+// Sends the output of a command. Commands acting on the linked account of the caller answer in the caller's query,
+// the channel only sees what the shared accounts do
+func (app *App) send(call invocation, text string) {
+	if call.account != personal_account {
+		app.ircAdapter.Send(text)
+		return
+	}
+	nick, err := app.ircAdapter.Author(call.messageID)
+	if err != nil {
+		log.Println("Could not get author of message:", err)
+		return
+	}
+	app.ircAdapter.SendTo(nick, text)
+}
+
+// Selects the account a command acts on: the account given by the selector (or the linked account of the caller for "@me")
+// or otherwise the account the messageID (if any) belongs to. Falls back to the default account.
+// If the selected account is not the one the messageID belongs to, the message is loaded into the selected account.
+// Returns the adapter, the alias to tag output with and the messageID valid for the adapter.
+func (app *App) social(call invocation, messageID MessageID) (SocialAdapter, string, MessageID, error) {
+	if call.account == "" {
+		social, alias := app.accountOf(messageID)
+		return social, alias, messageID, nil
+	}
+	var social SocialAdapter
+	alias := call.account
+	if call.account == personal_account {
+		account, err := app.ircAccount(call.messageID)
+		if err != nil {
+			return nil, "", "", err
+		}
+		if social, alias, err = app.linkedAccount(account); err != nil {
+			return nil, "", "", err
+		}
+	} else {
+		var ok bool
+		if social, ok = app.accounts[call.account]; !ok {
+			return nil, "", "", fmt.Errorf("Unknown account %s, known accounts are: %s", call.account, strings.Join(app.aliases, ", "))
+		}
+	}
+	if messageID == "" || social.HasMessage(messageID) {
+		return social, alias, messageID, nil
+	}
+	owner, _ := app.accountOf(messageID)
+	link, err := owner.Link(messageID)
+	if err != nil {
+		return nil, "", "", err
+	}
+	resolved, err := social.Resolve(link)
+	if err != nil {
+		return nil, "", "", fmt.Errorf("Could not load %s as %s: %w", messageID, alias, err)
+	}
+	return social, alias, resolved, nil
+}
+
+// Finds the account the messageID belongs to, preferring the default account.
+// Unknown (or empty) IDs belong to the default account.
+func (app *App) accountOf(messageID MessageID) (SocialAdapter, string) {
+	if messageID != "" {
+		for _, alias := range app.aliases {
+			if app.accounts[alias].HasMessage(messageID) {
+				return app.accounts[alias], alias
+			}
+		}
+	}
+	return app.defaultAccount(), app.aliases[0]
+}
+
+// Checks if any of the accounts knows the messageID
+func (app *App) knownMessage(messageID MessageID) bool {
+	for _, alias := range app.aliases {
+		if app.accounts[alias].HasMessage(messageID) {
+			return true
+		}
+	}
+	return false
+}
+
+func (app *App) defaultAccount() SocialAdapter {
+	return app.accounts[app.aliases[0]]
+}
+
+// Tags relayed text with the account alias it belongs to, unless it is the default account
+func (app *App) tag(alias string, text string) string {
+	if alias == app.aliases[0] {
+		return text
+	}
+	return fmt.Sprintf("[%s] %s", alias, text)
+}
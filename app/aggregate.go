@@ -0,0 +1,136 @@
+package app
+
+import (
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Favourites and boosts of the same toot within the window are relayed as one line
+const default_aggregation_window = 2 * time.Minute
+
+// Number of names listed before the rest is counted as "others"
+const aggregation_names = 2
+
+// Collects favourites and boosts per toot. Types in digest are not relayed when their window ends
+// but collected for the next digest.
+type aggregator struct {
+	mutex  sync.Mutex
+	window time.Duration
+	groups map[string]*notificationGroup
+	// Digest mode: interval and the notification types it applies to, interval 0 if disabled
+	digestInterval time.Duration
+	digestTypes    map[string]bool
+	digest         []string
+}
+
+type notificationGroup struct {
+	alias     string
+	msgtype   string
+	messageID string
+	actors    []string
+}
+
+// Sets the window favourites and boosts are grouped in, 0 relays each one on its own
+func (app *App) SetAggregationWindow(window time.Duration) {
+	app.aggregation.mutex.Lock()
+	defer app.aggregation.mutex.Unlock()
+	app.aggregation.window = window
+}
+
+// Enables digest mode: notifications of the given types ("favourite", "reblog") are collected and relayed
+// together every interval. Other types are refused, only aggregated notifications can be collected
+func (app *App) SetDigest(interval time.Duration, msgtypes []string) error {
+	types := make(map[string]bool)
+	for _, msgtype := range msgtypes {
+		msgtype = strings.TrimSpace(msgtype)
+		if msgtype != "favourite" && msgtype != "reblog" {
+			return fmt.Errorf("Only favourite and reblog can be collected into the digest, not '%s'", msgtype)
+		}
+		types[msgtype] = true
+	}
+	app.aggregation.mutex.Lock()
+	defer app.aggregation.mutex.Unlock()
+	app.aggregation.digestInterval = interval
+	app.aggregation.digestTypes = types
+	return nil
+}
+
+// Adds a favourite or boost by actor to the group of its toot, the first one starts the window
+func (app App) aggregate(alias string, msgtype string, actor string, messageID string) {
+	app.aggregation.mutex.Lock()
+	defer app.aggregation.mutex.Unlock()
+	key := alias + "/" + msgtype + "/" + messageID
+	group, found := app.aggregation.groups[key]
+	if !found {
+		group = &notificationGroup{alias: alias, msgtype: msgtype, messageID: messageID}
+		app.aggregation.groups[key] = group
+		time.AfterFunc(app.aggregation.window, func() { app.flushGroup(key) })
+	}
+	group.actors = append(group.actors, actor)
+}
+
+func (app App) flushGroup(key string) {
+	app.aggregation.mutex.Lock()
+	group := app.aggregation.groups[key]
+	if group == nil {
+		app.aggregation.mutex.Unlock()
+		return
+	}
+	delete(app.aggregation.groups, key)
+	digest := app.aggregation.digestInterval > 0 && app.aggregation.digestTypes[group.msgtype]
+	app.aggregation.mutex.Unlock()
+	line := app.tag(group.alias, app.describeGroup(group))
+	if digest {
+		app.aggregation.mutex.Lock()
+		app.aggregation.digest = append(app.aggregation.digest, line)
+		app.aggregation.mutex.Unlock()
+		return
+	}
+	app.ircAdapter.Send(line)
+}
+
+// E.g. "alice, bob and 7 others favourited [Ab3x] 'Open today…'"
+func (app App) describeGroup(group *notificationGroup) string {
+	names := group.actors
+	var who string
+	switch {
+	case len(names) == 1:
+		who = names[0]
+	case len(names) <= aggregation_names+1:
+		who = strings.Join(names[:len(names)-1], ", ") + " and " + names[len(names)-1]
+	default:
+		who = fmt.Sprintf("%s and %d others", strings.Join(names[:aggregation_names], ", "), len(names)-aggregation_names)
+	}
+	verb := "favourited"
+	if group.msgtype == "reblog" {
+		verb = "reblogged"
+	}
+	summary, err := app.accounts[group.alias].Summary(group.messageID)
+	if err != nil {
+		log.Println("Error summarizing", group.messageID, err)
+		return fmt.Sprintf("%s %s [%s]", who, verb, group.messageID)
+	}
+	return fmt.Sprintf("%s %s [%s] '%s'", who, verb, group.messageID, summary)
+}
+
+// Relays the collected digest every interval. Does nothing if digest mode is disabled
+func (app App) runDigest() {
+	app.aggregation.mutex.Lock()
+	interval := app.aggregation.digestInterval
+	app.aggregation.mutex.Unlock()
+	if interval == 0 {
+		return
+	}
+	for range time.Tick(interval) {
+		app.aggregation.mutex.Lock()
+		lines := app.aggregation.digest
+		app.aggregation.digest = nil
+		app.aggregation.mutex.Unlock()
+		if len(lines) > 0 {
+			app.ircAdapter.Send(fmt.Sprintf("Digest of the last %s:\n%s", interval, strings.Join(lines, "\n")))
+		}
+	}
+}
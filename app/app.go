@@ -1,22 +1,26 @@
 package app
 
 import (
+	"database/sql"
 	"fmt"
 	// "log"
 	"strings"
 	"sync"
+	"time"
 )
 
 const command_prefix = "."
 
-type commandfn func(app *App, message_type string, message string, messageID string)
+type commandfn func(app *App, call invocation)
 
 type command struct {
 	name                 string
 	description          string
 	nargs                int
 	elevated_permissions bool
-	action               commandfn
+	// Acts on the selected Mastodon account, so everybody may call it as their own linked account (@me)
+	personal bool
+	action   commandfn
 }
 
 type MessageHandler func(source string, message string, messageID string)
@@ -26,62 +30,163 @@ type MessageID = string
 type Adapter interface {
 	Send(message string) (MessageID, error)
 	Reply(messageID MessageID, message string) (MessageID, error)
+	// Sends a message to a specific target instead of the default one (e.g. an IRC query or a Mastodon direct message)
+	SendTo(target string, message string) (MessageID, error)
+	// Returns the name of whoever wrote the message given by messageID (IRC nick, Mastodon account, ...)
+	Author(messageID MessageID) (string, error)
+	// Returns where the message given by messageID was written, i.e. where a direct reply would go
+	Origin(messageID MessageID) (string, error)
+	// Returns the authenticated account (e.g. NickServ account) of the author, empty if the author is not authenticated
+	Account(messageID MessageID) (string, error)
+	// Describes the state of the adapter (connection, server, ...) for humans
+	Status() string
 	RegisterMessageHandler(MessageHandler)
 	Eventloop()
 }
 
+// A poll attached to a new message. ExpiresIn is rounded to seconds.
+type Poll struct {
+	Options   []string
+	ExpiresIn time.Duration
+	Multiple  bool
+}
+
 type SocialAdapter interface {
 	Adapter
+	SendPoll(message string, poll Poll) (MessageID, error)
+	// Votes in the poll of the given message. Choices are the indices (starting at 0) of the options
+	Vote(messageID MessageID, choices []int) error
 	Boost(messageID MessageID) (bool, error)
 	Favorite(messageID MessageID) (bool, error)
+	Bookmark(messageID MessageID) (bool, error)
+	Pin(messageID MessageID) (bool, error)
+	// Lists the latest bookmarks, one line per message
+	Bookmarks() ([]string, error)
+	Profile() (Profile, error)
+	UpdateProfile(profile Profile) error
+	// Reports a message (and its author) to the moderators, with forward also to those of the author's server
+	Report(messageID MessageID, comment string, forward bool) error
+	// Returns the domain of the author of a message
+	Domain(messageID MessageID) (string, error)
+	BlockDomain(domain string) error
+	UnblockDomain(domain string) error
+	DomainBlocks() ([]string, error)
+	// Server side filters. MatchFilter checks a message of the given type ("mention", "status", "update", "delete")
+	// before it is relayed, deleted messages are checked against what is known of them
+	MatchFilter(messageID string, msgtype string) (FilterMatch, bool)
+	Filters() ([]Filter, error)
+	AddFilter(keyword string, action FilterAction) error
+	RemoveFilter(keyword string) error
+	// A single line excerpt of the message, used in lists and aggregated notifications
+	Summary(messageID string) (string, error)
+	// Moderation via the admin API of the server, id is an account or report id depending on the action
+	Moderate(action ModerationAction, id string, text string) error
 	Search(context string) (MessageID, error)
+	// Loads the message behind a link and returns its ID
+	Resolve(link string) (MessageID, error)
+	// Returns the permanent link of a message, which other accounts can Resolve
+	Link(messageID MessageID) (string, error)
 	Delete(messageID MessageID) error
 	GetMessage(messageID MessageID) (string, error)
+	// Checks if the messageID is known to this adapter (e.g. was stored by this account)
+	HasMessage(messageID MessageID) bool
+	// Checks if the message is a direct message, which is only shown where direct messages are relayed to
+	IsDirect(messageID MessageID) bool
 }
 
 type App struct {
-	ircAdapter      Adapter
-	mastodonAdapter SocialAdapter
+	ircAdapter Adapter
+	// The Mastodon accounts of the bot by alias. The first alias is the default account
+	accounts    map[string]SocialAdapter
+	aliases     []string
+	db          *sql.DB
+	previews    *previewLimiter
+	direct      *directRelay
+	links       *linkedAccounts
+	profiles    *profileChanges
+	moderation  *moderation
+	aggregation *aggregator
+	quiet       *quietHours
+	// Keys of the toots which matched a filter
+	filteredKeys *filteredKeys
 }
 
-func New(irc Adapter, mastodon SocialAdapter) App {
-	app := App{
-		ircAdapter:      irc,
-		mastodonAdapter: mastodon,
+// Creates the App connecting both adapters. The Mastodon adapter becomes the default account with the given alias,
+// more accounts can be added via AddAccount. The database is used for app specific state
+// which does not belong to one of the adapters (e.g. users opting out of link previews).
+func New(irc Adapter, mastodon SocialAdapter, alias string, db *sql.DB) (*App, error) {
+	if _, err := db.Exec(create_table_preview_optout); err != nil {
+		return nil, err
+	}
+	if _, err := db.Exec(create_table_linked_accounts); err != nil {
+		return nil, err
+	}
+	if _, err := db.Exec(create_table_quiet_queue); err != nil {
+		return nil, err
+	}
+	app := &App{
+		ircAdapter: irc,
+		accounts:   make(map[string]SocialAdapter),
+		db:         db,
+		previews:   newPreviewLimiter(),
+		direct:     &directRelay{},
+		moderation: &moderation{},
+		quiet:      &quietHours{types: typeSet(default_quiet_types)},
+		filteredKeys: &filteredKeys{
+			keys: make(map[MessageID]bool),
+		},
+		aggregation: &aggregator{
+			window: default_aggregation_window,
+			groups: make(map[string]*notificationGroup),
+		},
+		profiles: &profileChanges{
+			pending: make(map[string]*pendingProfile),
+		},
+		links: &linkedAccounts{
+			pending:   make(map[string]string),
+			connected: make(map[string]linkedAccount),
+		},
 	}
 	irc.RegisterMessageHandler(app.handleIRCMessage)
-	mastodon.RegisterMessageHandler(app.handleMastodonMessage)
+	if err := app.AddAccount(alias, mastodon); err != nil {
+		return nil, err
+	}
 
-	return app
+	return app, nil
 }
 
 func (app *App) handleIRCMessage(msgtype string, message string, messageID string) {
 	// var err error
+	if app.handleDirectConversation(msgtype, message, messageID) {
+		return
+	}
+	if app.handleModeration(msgtype, message, messageID) {
+		return
+	}
 	if strings.HasPrefix(msgtype, "channel.") {
-    // log.Println("Handling Channel Message")
-		for _, cmd := range channel_commands {
-      // TODO: This is kind of jank. Split message at earliest possible whitespace and put that part into a map[string, command]
-      // Maybe have that map even replace the current commands slice
-			var space string
-			if cmd.nargs > 0 {
-				space = " "
-			} else {
-				space = ""
-			}
-      // log.Printf("Looking for '%s'\n", command_prefix+cmd.name+space)
-			if (!cmd.elevated_permissions || strings.HasSuffix(msgtype, ".op")) &&
-				strings.HasPrefix(message, command_prefix+cmd.name+space) {
-          cmd.action(app, msgtype, message, messageID)
-			}
+		call, cmd, found := parseInvocation(channel_command_map, msgtype, message, messageID)
+		if found && call.permitted(cmd) {
+			cmd.action(app, call)
+		}
+		if !strings.HasPrefix(message, command_prefix) {
+			app.previewLinks(message, messageID)
 		}
 	}
 	if strings.HasPrefix(msgtype, "direct.") {
     // log.Println("Handling /query message")
-		// TODO: Define specific commands for direct messages?
+		call, cmd, found := parseInvocation(direct_command_map, msgtype, message, messageID)
+		if found && call.permitted(cmd) {
+			cmd.action(app, call)
+			return
+		}
 
-    // For now always return a command list
-    reply := "Hi %s\n the only reply via query currently supported is a command list:\n"
+		// Otherwise return a command list
+		reply := "Hi %s\n these commands are supported via query:\n"
 		command_descriptions := ""
+		for _, cmd := range direct_commands {
+			command_descriptions = command_descriptions + fmt.Sprintln(command_prefix+cmd.name, cmd.description)
+		}
+		command_descriptions += "And these in the channel:\n"
 		for _, cmd := range channel_commands {
 			command_descriptions = command_descriptions + fmt.Sprintln(command_prefix+cmd.name, cmd.description)
 		}
@@ -89,32 +194,58 @@ func (app *App) handleIRCMessage(msgtype string, message string, messageID strin
 	}
 }
 
-func (app App) handleMastodonMessage(msgtype string, message string, messageID string) {
+// Handles the notifications of the Mastodon account with the given alias. Everything relayed from accounts other
+// than the default one is tagged with the alias.
+func (app App) handleMastodonMessage(alias string, msgtype string, message string, messageID string) {
+	social := app.accounts[alias]
+	if msgtype != "direct" && social.IsDirect(messageID) {
+		// Edits, deletions and favourites of direct messages stay with the direct messages
+		app.relayDirectNotice(alias, msgtype, message, messageID)
+		return
+	}
+	switch msgtype {
+	case "mention", "status", "update", "delete":
+		// Filtered before queueing, the summary of the quiet hours must not show them either
+		if app.filtered(social, alias, msgtype, messageID) {
+			return
+		}
+	}
+	if app.queueIfQuiet(alias, msgtype, message, messageID) {
+		return
+	}
 	switch msgtype {
 	case "mention":
 		// We've been mentioned!
-		app.ircAdapter.Send("We've been mentioned!")
-		message, err := app.mastodonAdapter.GetMessage(messageID)
+		app.ircAdapter.Send(app.tag(alias, "We've been mentioned!"))
+		message, err := social.GetMessage(messageID)
 		if err != nil {
 			app.ircAdapter.Send("But I failed to get the message")
 			app.ircAdapter.Send(err.Error())
 		} else {
 			app.ircAdapter.Send(message)
 		}
+	case "direct":
+		app.relayDirectMessage(alias, message, messageID)
 	case "status":
-		message, err := app.mastodonAdapter.GetMessage(messageID)
+		message, err := social.GetMessage(messageID)
 		if err != nil {
 			app.ircAdapter.Send("I failed to get the message %s") // TODO
 			app.ircAdapter.Send(err.Error())
 		} else {
-			app.ircAdapter.Send(message)
+			app.ircAdapter.Send(app.tag(alias, message))
 		}
-	case "favourite":
-		app.ircAdapter.Send(fmt.Sprintf("%s favourited a toot of ours", message))
-	case "reblog":
-		app.ircAdapter.Send(fmt.Sprintf("%s reblogged a toot of ours", message))
+	case "update", "delete":
+		// Edits come as diff against what was relayed, deletions with the now dead key
+		app.ircAdapter.Send(app.tag(alias, message))
+	case "poll":
+		app.ircAdapter.Send(app.tag(alias, "A poll has ended!"))
+		app.ircAdapter.Send(message)
+	case "favourite", "reblog":
+		app.aggregate(alias, msgtype, message, messageID)
+	case "admin.sign_up", "admin.report":
+		app.relayModeration(alias, message)
 	case "moin":
-		app.ircAdapter.Send(fmt.Sprintf("@%s sagt moin!", message))
+		app.ircAdapter.Send(app.tag(alias, fmt.Sprintf("@%s sagt moin!", message)))
 	}
 }
 
@@ -122,15 +253,19 @@ func (app App) handleMastodonMessage(msgtype string, message string, messageID s
 // The app itself does not not run in a dedicated thread. It is just called by event handling goroutines
 func (app App) Run() {
 	var wg sync.WaitGroup
-	wg.Add(2)
+	wg.Add(1 + len(app.aliases))
 	go func() {
 		defer wg.Done()
 		app.ircAdapter.Eventloop()
 	}()
-	go func() {
-		defer wg.Done()
-		app.mastodonAdapter.Eventloop()
-	}()
+	go app.runDigest()
+	go app.runQuietHours()
+	for _, alias := range app.aliases {
+		go func(social SocialAdapter) {
+			defer wg.Done()
+			social.Eventloop()
+		}(app.accounts[alias])
+	}
 
 	wg.Wait()
 }
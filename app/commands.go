@@ -5,97 +5,156 @@ import (
 	"log"
 	"strings"
 )
-// TODO: Build and use this instead
+
+// Built from channel_commands, direct_commands and moderation_commands on startup, maps the command names to the commands
 var channel_command_map = map[string]command{}
+var direct_command_map = map[string]command{}
+var moderation_command_map = map[string]command{}
+
+func init() {
+	for _, cmd := range channel_commands {
+		channel_command_map[cmd.name] = cmd
+	}
+	for _, cmd := range direct_commands {
+		direct_command_map[cmd.name] = cmd
+	}
+	for _, cmd := range moderation_commands {
+		moderation_command_map[cmd.name] = cmd
+	}
+}
 
 var channel_commands = []command{
 	{
-		name:  "t",
-    description: "Posts a toot. Toot content is the text following after",
-		nargs: 1,
-    elevated_permissions: true,
-    action: func(app *App, message_type, message, messageID string) {
+		name:                 "t",
+		description:          "Posts a toot. Toot content is the text following after. Append \"|| option 1 | option 2 [|| duration] [|| multiple]\" for a poll",
+		nargs:                1,
+		elevated_permissions: true,
+		personal:             true,
+		action: func(app *App, call invocation) {
+			social, alias, _, err := app.social(call, "")
+			if err != nil {
+				app.ircAdapter.Reply(call.messageID, err.Error())
+				return
+			}
 			var id string
-			tootMessage := strings.TrimPrefix(message, ".t ")
-			id, err := app.mastodonAdapter.Send(tootMessage)
+			tootMessage, poll, err := parsePoll(call.args)
+			if err != nil {
+				app.ircAdapter.Reply(call.messageID, fmt.Sprintf("Error in poll: %v", err))
+				return
+			}
+			if poll != nil {
+				id, err = social.SendPoll(tootMessage, *poll)
+			} else {
+				id, err = social.Send(tootMessage)
+			}
 			if err == nil {
-				app.ircAdapter.Send(fmt.Sprintf("[%s] Toot successfull", id))
-				tootmessage, _ := app.mastodonAdapter.GetMessage(id)
-				app.ircAdapter.Send(tootmessage)
+				app.send(call, app.tag(alias, fmt.Sprintf("[%s] Toot successfull", id)))
+				tootmessage, _ := social.GetMessage(id)
+				app.send(call, tootmessage)
 			} else {
-				app.ircAdapter.Reply(messageID, fmt.Sprintf("Error during sending: %v", err))
+				app.ircAdapter.Reply(call.messageID, fmt.Sprintf("Error during sending: %v", err))
 			}
 		},
 	}, {
-		name:  "r",
-    description: "Replies to a toot. First parameter is the ID to reply to, everything after is the content of the reply",
-		nargs: 2,
-    elevated_permissions: true,
-		action: func(app *App, message_type, message, messageID string) {
-			split := strings.SplitAfterN(strings.TrimPrefix(message, ".r "), " ", 2)
-			replyTo := strings.TrimSuffix(split[0], " ")
+		name:                 "r",
+		description:          "Replies to a toot. First parameter is the ID to reply to, everything after is the content of the reply",
+		nargs:                2,
+		elevated_permissions: true,
+		personal:             true,
+		action: func(app *App, call invocation) {
+			split := strings.SplitN(call.args, " ", 2)
+			if len(split) < 2 {
+				app.ircAdapter.Reply(call.messageID, "Please provide a toot ID and the reply")
+				return
+			}
+			replyTo := split[0]
 			replyText := split[1]
-			id, err := app.mastodonAdapter.Reply(replyTo, replyText)
+			social, alias, replyTo, err := app.social(call, replyTo)
+			if err != nil {
+				app.ircAdapter.Reply(call.messageID, err.Error())
+				return
+			}
+			if social.IsDirect(replyTo) && !app.inDirectTarget(call.messageID) {
+				// The reply and its key would end up here, away from the direct messages
+				app.ircAdapter.Reply(call.messageID, fmt.Sprintf("%s is a direct message, answer it where direct messages are relayed to", replyTo))
+				return
+			}
+			id, err := social.Reply(replyTo, replyText)
 			if err == nil {
-				app.ircAdapter.Send(fmt.Sprintf("[%s] Reply successfull", id))
-				tootmessage, _ := app.mastodonAdapter.GetMessage(id)
-				app.ircAdapter.Send(tootmessage)
+				app.send(call, app.tag(alias, fmt.Sprintf("[%s] Reply successfull", id)))
+				tootmessage, _ := social.GetMessage(id)
+				app.send(call, tootmessage)
 			} else {
-				app.ircAdapter.Reply(messageID, fmt.Sprintf("Error replying: %v", err))
+				app.ircAdapter.Reply(call.messageID, fmt.Sprintf("Error replying: %v", err))
 			}
 		},
 	}, {
-		name:  "?",
-    description: "The help command (redirects you to here)",
-		nargs: 0,
-    elevated_permissions: false,
-		action: func(app *App, message_type, message, messageID string) {
-      _, err := app.ircAdapter.Reply(messageID, "To get to know the commands please send me a message via /query")
-      if err != nil {
-        log.Println("Error replying:", err)
-      }
+		name:                 "?",
+		description:          "The help command (redirects you to here)",
+		nargs:                0,
+		elevated_permissions: false,
+		action: func(app *App, call invocation) {
+			_, err := app.ircAdapter.Reply(call.messageID, "To get to know the commands please send me a message via /query")
+			if err != nil {
+				log.Println("Error replying:", err)
+			}
 		},
 	}, {
-		name:  "d",
-    description: "Deletes a toot. One parameter with the toot's id expected",
-		nargs: 1,
-    elevated_permissions: true,
-		action: func(app *App, message_type, message, messageID string) {
-			tootID := strings.TrimPrefix(message, ".d ")
-			err := app.mastodonAdapter.Delete(tootID)
+		name:                 "d",
+		description:          "Deletes a toot. One parameter with the toot's id expected",
+		nargs:                1,
+		elevated_permissions: true,
+		personal:             true,
+		action: func(app *App, call invocation) {
+			social, alias, tootID, err := app.social(call, call.args)
+			if err != nil {
+				app.ircAdapter.Reply(call.messageID, err.Error())
+				return
+			}
+			err = social.Delete(tootID)
 			if err == nil {
-				app.ircAdapter.Send(fmt.Sprintf("Successfully deleted toot %s", tootID))
+				app.send(call, app.tag(alias, fmt.Sprintf("Successfully deleted toot %s", tootID)))
 			} else {
-				app.ircAdapter.Send(fmt.Sprintf("Error deleting toot: %v", err))
+				app.send(call, fmt.Sprintf("Error deleting toot: %v", err))
 			}
 		},
 	}, {
-		name:  "s",
-    description: "Search a toot & load it into the bot to get a ID for other commands. Parameter should be the permanent link",
-		nargs: 1,
-    elevated_permissions: true,
-		action: func(app *App, message_type, message, messageID string) {
+		name:                 "s",
+		description:          "Search a toot & load it into the bot to get a ID for other commands. Parameter should be the permanent link",
+		nargs:                1,
+		elevated_permissions: true,
+		personal:             true,
+		action: func(app *App, call invocation) {
+			social, _, _, err := app.social(call, "")
+			if err != nil {
+				app.ircAdapter.Reply(call.messageID, err.Error())
+				return
+			}
 			// search & load toot
-			content := strings.TrimPrefix(message, ".s ")
-			tootMessage, err := app.mastodonAdapter.Search(content)
+			tootMessage, err := social.Search(call.args)
 			if err == nil {
 				if tootMessage != "" {
-					app.ircAdapter.Send(tootMessage)
+					app.send(call, tootMessage)
 				} else {
-					app.ircAdapter.Send(fmt.Sprintf("No toot found"))
+					app.send(call, fmt.Sprintf("No toot found"))
 				}
 			} else {
-				app.ircAdapter.Send(fmt.Sprintf("Error finding toot: %v", err))
+				app.send(call, fmt.Sprintf("Error finding toot: %v", err))
 			}
 		},
 	}, {
-		name:  "b",
-    description: "(Un-)Boosts a toot (toggle). Parameter is the ID of the toot to boost",
-		nargs: 1,
-    elevated_permissions: true,
-		action: func(app *App, message_type, message, messageID string) {
-			tootID := strings.TrimPrefix(message, ".b ")
-			boosted, err := app.mastodonAdapter.Boost(tootID)
+		name:                 "b",
+		description:          "(Un-)Boosts a toot (toggle). Parameter is the ID of the toot to boost",
+		nargs:                1,
+		elevated_permissions: true,
+		personal:             true,
+		action: func(app *App, call invocation) {
+			social, alias, tootID, err := app.social(call, call.args)
+			if err != nil {
+				app.ircAdapter.Reply(call.messageID, err.Error())
+				return
+			}
+			boosted, err := social.Boost(tootID)
 			if err == nil {
 				var action string
 				if boosted {
@@ -103,19 +162,24 @@ var channel_commands = []command{
 				} else {
 					action = "Un-Boosted"
 				}
-				app.ircAdapter.Send(fmt.Sprintf("%s %s", action, tootID))
+				app.send(call, app.tag(alias, fmt.Sprintf("%s %s", action, tootID)))
 			} else {
-				app.ircAdapter.Send(fmt.Sprintf("Error boosting toot: %v", err))
+				app.send(call, fmt.Sprintf("Error boosting toot: %v", err))
 			}
 		},
 	}, {
-		name:  "f",
-    description: "(Un-)Favourites a toot (toggle). Parameter is the ID of the toot to favourite",
-		nargs: 1,
-    elevated_permissions: true,
-		action: func(app *App, message_type, message, messageID string) {
-			tootID := strings.TrimPrefix(message, ".f ")
-			boosted, err := app.mastodonAdapter.Favorite(tootID)
+		name:                 "f",
+		description:          "(Un-)Favourites a toot (toggle). Parameter is the ID of the toot to favourite",
+		nargs:                1,
+		elevated_permissions: true,
+		personal:             true,
+		action: func(app *App, call invocation) {
+			social, alias, tootID, err := app.social(call, call.args)
+			if err != nil {
+				app.ircAdapter.Reply(call.messageID, err.Error())
+				return
+			}
+			boosted, err := social.Favorite(tootID)
 			if err == nil {
 				var action string
 				if boosted {
@@ -123,9 +187,353 @@ var channel_commands = []command{
 				} else {
 					action = "Un-Faved"
 				}
-				app.ircAdapter.Send(fmt.Sprintf("%s %s", action, tootID))
+				app.send(call, app.tag(alias, fmt.Sprintf("%s %s", action, tootID)))
+			} else {
+				app.send(call, fmt.Sprintf("Error favoriting toot: %s", err))
+			}
+		},
+	}, {
+		name:                 "bm",
+		description:          "(Un-)Bookmarks a toot (toggle). Parameter is the ID of the toot to bookmark",
+		nargs:                1,
+		elevated_permissions: true,
+		personal:             true,
+		action: func(app *App, call invocation) {
+			social, alias, tootID, err := app.social(call, call.args)
+			if err != nil {
+				app.ircAdapter.Reply(call.messageID, err.Error())
+				return
+			}
+			bookmarked, err := social.Bookmark(tootID)
+			if err == nil {
+				var action string
+				if bookmarked {
+					action = "Bookmarked"
+				} else {
+					action = "Un-Bookmarked"
+				}
+				app.send(call, app.tag(alias, fmt.Sprintf("%s %s", action, tootID)))
+			} else {
+				app.send(call, fmt.Sprintf("Error bookmarking toot: %v", err))
+			}
+		},
+	}, {
+		name:                 "bml",
+		description:          "Lists our latest bookmarks with their IDs",
+		nargs:                0,
+		elevated_permissions: true,
+		personal:             true,
+		action: func(app *App, call invocation) {
+			social, alias, _, err := app.social(call, "")
+			if err != nil {
+				app.ircAdapter.Reply(call.messageID, err.Error())
+				return
+			}
+			bookmarks, err := social.Bookmarks()
+			if err != nil {
+				app.send(call, fmt.Sprintf("Error listing bookmarks: %v", err))
+			} else if len(bookmarks) == 0 {
+				app.send(call, app.tag(alias, "No bookmarks"))
+			} else {
+				app.send(call, app.tag(alias, strings.Join(bookmarks, "\n")))
+			}
+		},
+	}, {
+		name:                 "pin",
+		description:          "(Un-)Pins one of our toots to the profile (toggle). Parameter is the ID of the toot to pin",
+		nargs:                1,
+		elevated_permissions: true,
+		personal:             true,
+		action: func(app *App, call invocation) {
+			social, alias, tootID, err := app.social(call, call.args)
+			if err != nil {
+				app.ircAdapter.Reply(call.messageID, err.Error())
+				return
+			}
+			pinned, err := social.Pin(tootID)
+			if err == nil {
+				var action string
+				if pinned {
+					action = "Pinned"
+				} else {
+					action = "Un-Pinned"
+				}
+				app.send(call, app.tag(alias, fmt.Sprintf("%s %s", action, tootID)))
+			} else {
+				app.send(call, fmt.Sprintf("Error pinning toot: %v", err))
+			}
+		},
+	}, {
+		name:                 "v",
+		description:          "Votes in a poll. First parameter is the ID of the toot with the poll, followed by the number(s) of the option(s) to vote for",
+		nargs:                2,
+		elevated_permissions: true,
+		personal:             true,
+		action: func(app *App, call invocation) {
+			split := strings.Fields(call.args)
+			if len(split) < 2 {
+				app.ircAdapter.Reply(call.messageID, "Please provide a toot ID and at least one option number")
+				return
+			}
+			tootID := split[0]
+			choices, err := parseVoteChoices(split[1:])
+			if err != nil {
+				app.ircAdapter.Reply(call.messageID, fmt.Sprintf("Error voting: %v", err))
+				return
+			}
+			social, alias, tootID, err := app.social(call, tootID)
+			if err != nil {
+				app.ircAdapter.Reply(call.messageID, err.Error())
+				return
+			}
+			err = social.Vote(tootID, choices)
+			if err == nil {
+				app.send(call, app.tag(alias, fmt.Sprintf("Voted in poll %s", tootID)))
+			} else {
+				app.send(call, fmt.Sprintf("Error voting: %v", err))
+			}
+		},
+	}, {
+		name:                 "report",
+		description:          "Reports a toot to the moderators. First parameter is the ID of the toot, optionally followed by +forward (also report to the author's instance) and +block (block the author's domain), everything after is the comment",
+		nargs:                1,
+		elevated_permissions: true,
+		personal:             true,
+		action: func(app *App, call invocation) {
+			tootID, rest, _ := strings.Cut(call.args, " ")
+			forward := false
+			block := false
+			words := strings.Fields(rest)
+			for len(words) > 0 && strings.HasPrefix(words[0], "+") {
+				switch words[0] {
+				case "+forward":
+					forward = true
+				case "+block":
+					block = true
+				default:
+					app.ircAdapter.Reply(call.messageID, fmt.Sprintf("Unknown option %s, use +forward or +block", words[0]))
+					return
+				}
+				words = words[1:]
+			}
+			comment := strings.Join(words, " ")
+			social, alias, tootID, err := app.social(call, tootID)
+			if err != nil {
+				app.ircAdapter.Reply(call.messageID, err.Error())
+				return
+			}
+			if author, err := app.ircAdapter.Author(call.messageID); err == nil {
+				comment = strings.TrimSpace(fmt.Sprintf("%s (reported by %s via IRC)", comment, author))
+			}
+			if err = social.Report(tootID, comment, forward); err != nil {
+				app.send(call, fmt.Sprintf("Error reporting toot: %v", err))
+				return
+			}
+			app.send(call, app.tag(alias, fmt.Sprintf("Reported %s", tootID)))
+			if block {
+				domain, err := social.Domain(tootID)
+				if err == nil {
+					err = social.BlockDomain(domain)
+				}
+				if err != nil {
+					app.send(call, fmt.Sprintf("Error blocking domain: %v", err))
+				} else {
+					app.send(call, app.tag(alias, fmt.Sprintf("Blocked domain %s", domain)))
+				}
+			}
+		},
+	}, {
+		name:                 "blockdomain",
+		description:          "Blocks a domain. Parameter is the domain or the ID of a toot whose author's domain should be blocked",
+		nargs:                1,
+		elevated_permissions: true,
+		personal:             true,
+		action: func(app *App, call invocation) {
+			domain := call.args
+			tootID := ""
+			if app.knownMessage(call.args) {
+				tootID = call.args
+			}
+			social, alias, tootID, err := app.social(call, tootID)
+			if err != nil {
+				app.ircAdapter.Reply(call.messageID, err.Error())
+				return
+			}
+			if tootID != "" {
+				if domain, err = social.Domain(tootID); err != nil {
+					app.send(call, fmt.Sprintf("Error blocking domain: %v", err))
+					return
+				}
+			}
+			if err = social.BlockDomain(domain); err != nil {
+				app.send(call, fmt.Sprintf("Error blocking domain: %v", err))
+			} else {
+				app.send(call, app.tag(alias, fmt.Sprintf("Blocked domain %s", domain)))
+			}
+		},
+	}, {
+		name:                 "unblockdomain",
+		description:          "Removes the block of a domain. Parameter is the domain",
+		nargs:                1,
+		elevated_permissions: true,
+		personal:             true,
+		action: func(app *App, call invocation) {
+			social, alias, _, err := app.social(call, "")
+			if err != nil {
+				app.ircAdapter.Reply(call.messageID, err.Error())
+				return
+			}
+			if err = social.UnblockDomain(call.args); err != nil {
+				app.send(call, fmt.Sprintf("Error unblocking domain: %v", err))
+			} else {
+				app.send(call, app.tag(alias, fmt.Sprintf("Unblocked domain %s", call.args)))
+			}
+		},
+	}, {
+		name:                 "domainblocks",
+		description:          "Lists the blocked domains",
+		nargs:                0,
+		elevated_permissions: true,
+		personal:             true,
+		action: func(app *App, call invocation) {
+			social, alias, _, err := app.social(call, "")
+			if err != nil {
+				app.ircAdapter.Reply(call.messageID, err.Error())
+				return
+			}
+			domains, err := social.DomainBlocks()
+			if err != nil {
+				app.send(call, fmt.Sprintf("Error listing domain blocks: %v", err))
+			} else if len(domains) == 0 {
+				app.send(call, app.tag(alias, "No blocked domains"))
+			} else {
+				app.send(call, app.tag(alias, "Blocked domains: "+strings.Join(domains, ", ")))
+			}
+		},
+	}, {
+		name:                 "filter",
+		description:          "Adds a keyword to the filters, matching toots are collapsed into one line. With 'hide' before the keyword they are not relayed at all",
+		nargs:                1,
+		elevated_permissions: true,
+		personal:             true,
+		action: func(app *App, call invocation) {
+			social, alias, _, err := app.social(call, "")
+			if err != nil {
+				app.ircAdapter.Reply(call.messageID, err.Error())
+				return
+			}
+			action := FilterWarn
+			keyword := call.args
+			if rest, found := strings.CutPrefix(keyword, "hide "); found {
+				action = FilterHide
+				keyword = strings.TrimSpace(rest)
+			}
+			if err = social.AddFilter(keyword, action); err != nil {
+				app.send(call, fmt.Sprintf("Error adding filter: %v", err))
+			} else {
+				app.send(call, app.tag(alias, fmt.Sprintf("Filtering %s (%s)", keyword, action)))
+			}
+		},
+	}, {
+		name:                 "unfilter",
+		description:          "Removes a keyword from the filters. Parameter is the keyword",
+		nargs:                1,
+		elevated_permissions: true,
+		personal:             true,
+		action: func(app *App, call invocation) {
+			social, alias, _, err := app.social(call, "")
+			if err != nil {
+				app.ircAdapter.Reply(call.messageID, err.Error())
+				return
+			}
+			if err = social.RemoveFilter(call.args); err != nil {
+				app.send(call, fmt.Sprintf("Error removing filter: %v", err))
+			} else {
+				app.send(call, app.tag(alias, fmt.Sprintf("No longer filtering %s", call.args)))
+			}
+		},
+	}, {
+		name:                 "filters",
+		description:          "Lists the filters and their keywords",
+		nargs:                0,
+		elevated_permissions: true,
+		personal:             true,
+		action: func(app *App, call invocation) {
+			social, alias, _, err := app.social(call, "")
+			if err != nil {
+				app.ircAdapter.Reply(call.messageID, err.Error())
+				return
+			}
+			filters, err := social.Filters()
+			if err != nil {
+				app.send(call, fmt.Sprintf("Error listing filters: %v", err))
+				return
+			}
+			if len(filters) == 0 {
+				app.send(call, app.tag(alias, "No filters"))
+				return
+			}
+			lines := []string{}
+			for _, f := range filters {
+				lines = append(lines, f.describe())
+			}
+			app.send(call, app.tag(alias, strings.Join(lines, "\n")))
+		},
+	}, {
+		name:                 "accounts",
+		description:          "Lists the Mastodon accounts of the bot. Select one for a command by appending @alias to the command, e.g. .t@alias",
+		nargs:                0,
+		elevated_permissions: false,
+		action: func(app *App, call invocation) {
+			app.ircAdapter.Reply(call.messageID, fmt.Sprintf("Accounts: %s (default: %s)", strings.Join(app.aliases, ", "), app.aliases[0]))
+		},
+	}, {
+		name:                 "profile",
+		description:          "Shows the profile, or previews a change of it: name [display name], bio [text], field [name]=[value], avatar [image URL] or header [image URL]. Changes are applied with \"confirm\" and discarded with \"cancel\"",
+		nargs:                0,
+		elevated_permissions: true,
+		personal:             true,
+		action: func(app *App, call invocation) {
+			app.profileCommand(call)
+		},
+	}, {
+		name:                 "status",
+		description:          "Shows the state of the IRC connection and the Mastodon accounts (server software, limits)",
+		nargs:                0,
+		elevated_permissions: false,
+		action: func(app *App, call invocation) {
+			lines := []string{app.ircAdapter.Status()}
+			for _, alias := range app.aliases {
+				lines = append(lines, fmt.Sprintf("%s: %s", alias, app.accounts[alias].Status()))
+			}
+			app.ircAdapter.Reply(call.messageID, strings.Join(lines, "\n"))
+		},
+	}, {
+		name:                 "quiet",
+		description:          "Pauses relaying notifications: .quiet on [duration], .quiet off (relays a summary of what was missed) or .quiet for the current state",
+		nargs:                0,
+		elevated_permissions: true,
+		action: func(app *App, call invocation) {
+			app.quietCommand(call)
+		},
+	}, {
+		name:                 "nopreview",
+		description:          "Toggles whether toot links you post in the channel get previewed by the bot",
+		nargs:                0,
+		elevated_permissions: false,
+		action: func(app *App, call invocation) {
+			user, err := app.ircAdapter.Author(call.messageID)
+			if err != nil {
+				log.Println("Error getting author of message:", err)
+				return
+			}
+			optedOut, err := app.togglePreviewOptOut(user)
+			if err != nil {
+				app.ircAdapter.Reply(call.messageID, fmt.Sprintf("Error changing preview setting: %v", err))
+			} else if optedOut {
+				app.ircAdapter.Reply(call.messageID, "Your toot links will no longer be previewed")
 			} else {
-				app.ircAdapter.Send(fmt.Sprintf("Error favoriting toot: %s", err))
+				app.ircAdapter.Reply(call.messageID, "Your toot links will be previewed again")
 			}
 		},
 	},
@@ -0,0 +1,124 @@
+package app
+
+import (
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+)
+
+// Direct Mastodon messages must not end up in the public channel. They are relayed to a target
+// (the query of an op or an ops-only channel) instead, where they can be answered as well.
+type directRelay struct {
+	mutex  sync.Mutex
+	target string
+	// The latest relayed direct message, plain text in the target replies to it
+	latest MessageID
+}
+
+// Sets where direct messages are relayed to. A target starting with "#" is a channel, anything else a nick.
+// Without a target direct messages are only announced, never shown.
+func (app *App) SetDirectTarget(target string) {
+	app.direct.mutex.Lock()
+	defer app.direct.mutex.Unlock()
+	app.direct.target = target
+}
+
+func (app App) relayDirectMessage(alias string, message string, messageID string) {
+	app.direct.mutex.Lock()
+	target := app.direct.target
+	if target != "" {
+		app.direct.latest = messageID
+	}
+	app.direct.mutex.Unlock()
+
+	if target == "" {
+		// Neither the key nor the content belong into the channel
+		app.ircAdapter.Send(app.tag(alias, "We received a direct message. No target to relay direct messages to is configured"))
+		return
+	}
+	app.ircAdapter.SendTo(target, app.tag(alias, "Direct message:\n"+message))
+	app.ircAdapter.SendTo(target, fmt.Sprintf("Answer with .r %s [reply] or write without command to reply to the latest direct message", messageID))
+}
+
+// Relays other notifications about a direct message (edits, deletions, favourites) to the target. They are dropped
+// without target, the channel must not learn about direct messages
+func (app App) relayDirectNotice(alias string, msgtype string, message string, messageID string) {
+	app.direct.mutex.Lock()
+	target := app.direct.target
+	app.direct.mutex.Unlock()
+	if target == "" {
+		return
+	}
+	switch msgtype {
+	case "favourite":
+		message = fmt.Sprintf("%s favourited the direct message [%s]", message, messageID)
+	case "reblog":
+		message = fmt.Sprintf("%s reblogged the direct message [%s]", message, messageID)
+	}
+	app.ircAdapter.SendTo(target, app.tag(alias, message))
+}
+
+// Whether the message was written where direct messages are relayed to
+func (app *App) inDirectTarget(messageID string) bool {
+	app.direct.mutex.Lock()
+	target := app.direct.target
+	app.direct.mutex.Unlock()
+	origin, err := app.ircAdapter.Origin(messageID)
+	return target != "" && err == nil && strings.EqualFold(origin, target)
+}
+
+// Handles IRC messages written where direct messages are relayed to. Returns false if the message was not written there.
+// Only operators can answer direct messages, replies are always sent with direct visibility.
+func (app *App) handleDirectConversation(msgtype string, message string, messageID string) bool {
+	app.direct.mutex.Lock()
+	target := app.direct.target
+	latest := app.direct.latest
+	app.direct.mutex.Unlock()
+	if target == "" {
+		return false
+	}
+	origin, err := app.ircAdapter.Origin(messageID)
+	if err != nil {
+		log.Println("Could not get origin of message:", err)
+		return false
+	}
+	if !strings.EqualFold(origin, target) {
+		return false
+	}
+	if !strings.HasSuffix(msgtype, ".op") {
+		// Not our business, but don't answer with the command list either
+		return strings.HasPrefix(msgtype, "channel.")
+	}
+
+	var replyTo, replyText string
+	if strings.HasPrefix(message, command_prefix+"r ") {
+		split := strings.SplitN(strings.TrimPrefix(message, command_prefix+"r "), " ", 2)
+		if len(split) < 2 {
+			app.ircAdapter.Reply(messageID, "Usage: .r [message key] [reply]")
+			return true
+		}
+		replyTo, replyText = split[0], split[1]
+	} else if _, _, found := parseInvocation(direct_command_map, msgtype, message, messageID); found && strings.HasPrefix(msgtype, "direct.") {
+		// Query commands still work in the query of the target
+		return false
+	} else if strings.HasPrefix(message, command_prefix) {
+		// Other commands are not available here
+		app.ircAdapter.Reply(messageID, "Only replies (.r) are supported here")
+		return true
+	} else if latest == "" {
+		app.ircAdapter.Reply(messageID, "There is no direct message to reply to")
+		return true
+	} else {
+		replyTo, replyText = latest, message
+	}
+
+	social, _ := app.accountOf(replyTo)
+	id, err := social.Reply(replyTo, replyText)
+	if err != nil {
+		app.ircAdapter.Reply(messageID, fmt.Sprintf("Error replying: %v", err))
+	} else {
+		app.ircAdapter.Reply(messageID, fmt.Sprintf("[%s] Direct reply to %s sent", id, replyTo))
+	}
+	return true
+}
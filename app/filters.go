@@ -0,0 +1,97 @@
+package app
+
+import (
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+)
+
+// How many filtered keys are remembered, their edits and deletions are not relayed either
+const filtered_keys_cache = 1000
+
+// What happens to content matching a filter: hidden content is not relayed at all,
+// for warn a single line naming the filter is relayed instead of the content
+type FilterAction string
+
+const (
+	FilterWarn FilterAction = "warn"
+	FilterHide FilterAction = "hide"
+)
+
+// A filter of the account, as configured on the server
+type Filter struct {
+	Title    string
+	Action   FilterAction
+	Context  []string
+	Keywords []string
+}
+
+type FilterMatch struct {
+	Title   string
+	Keyword string
+	Action  FilterAction
+}
+
+// The keys filtered recently, oldest first
+type filteredKeys struct {
+	mutex sync.Mutex
+	keys  map[MessageID]bool
+	order []MessageID
+}
+
+func (f *filteredKeys) add(messageID MessageID) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	if f.keys[messageID] {
+		return
+	}
+	f.keys[messageID] = true
+	f.order = append(f.order, messageID)
+	if len(f.order) > filtered_keys_cache {
+		delete(f.keys, f.order[0])
+		f.order = f.order[1:]
+	}
+}
+
+func (f *filteredKeys) contains(messageID MessageID) bool {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	return f.keys[messageID]
+}
+
+// Checks a message against the filters of the account before it is relayed. Returns true if the message
+// was filtered, in which case it must not be relayed.
+func (app App) filtered(social SocialAdapter, alias string, msgtype string, messageID string) bool {
+	if msgtype == "update" || msgtype == "delete" {
+		if app.filteredKeys.contains(messageID) {
+			// The toot was collapsed or hidden when relayed, its edits and deletion would reveal what it said
+			log.Println("Hiding", msgtype, "of filtered", messageID)
+			return true
+		}
+	}
+	match, found := social.MatchFilter(messageID, msgtype)
+	if !found {
+		return false
+	}
+	app.filteredKeys.add(messageID)
+	if match.Action == FilterHide {
+		log.Println("Hiding", messageID, "matching filter", match.Title)
+		return true
+	}
+	if app.paused(msgtype) {
+		// Not queued, the summary would show what the filter collapsed
+		log.Println("Dropping collapsed", messageID, "during quiet hours")
+		return true
+	}
+	author, err := social.Author(messageID)
+	if err != nil {
+		author = "unknown"
+	}
+	app.ircAdapter.Send(app.tag(alias, fmt.Sprintf("[%s] Toot by %s collapsed, it matches the filter '%s' (%s)", messageID, author, match.Title, match.Keyword)))
+	return true
+}
+
+func (f Filter) describe() string {
+	return fmt.Sprintf("%s (%s, %s): %s", f.Title, f.Action, strings.Join(f.Context, ", "), strings.Join(f.Keywords, ", "))
+}
@@ -0,0 +1,355 @@
+package app
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+const create_table_linked_accounts = `
+  CREATE TABLE IF NOT EXISTS linked_accounts(
+    account TEXT NOT NULL PRIMARY KEY,
+    time DATETIME NOT NULL,
+    credential BLOB NOT NULL
+  );
+  CREATE TABLE IF NOT EXISTS link_salt(
+    salt BLOB NOT NULL
+  );
+`
+
+// Length of the random salt the encryption key of the linked accounts is derived with
+const link_salt_length = 32
+
+// Distinguishes the key from other keys that might be derived from the same secret one day
+const link_key_info = "LetsGoTroet linked accounts"
+
+// Selects the linked account of whoever calls a command, as in ".t@me"
+const personal_account = "me"
+
+// Links the social media accounts of individual users to their IRC account, e.g. via OAuth.
+// Credentials are opaque to the app, they are stored encrypted.
+type Linker interface {
+	// Starts linking an account on the given instance. Returns the URL where the user authorizes the bot
+	// and the state to pass to FinishLink.
+	StartLink(instance string) (string, string, error)
+	// Finishes linking with the code the user got after authorizing. Returns the credential for Connect.
+	FinishLink(state string, code string) (string, error)
+	// Creates an adapter acting as the linked account and returns it together with the account's name
+	Connect(credential string) (SocialAdapter, string, error)
+}
+
+type linkedAccounts struct {
+	mutex  sync.Mutex
+	linker Linker
+	aead   cipher.AEAD
+	// Links started but not finished yet, by IRC account
+	pending map[string]string
+	// Adapters of linked accounts connected so far, by IRC account
+	connected map[string]linkedAccount
+}
+
+type linkedAccount struct {
+	social SocialAdapter
+	name   string
+}
+
+// Enables linking personal accounts. The secret is used to encrypt the stored credentials,
+// changing it invalidates all links.
+func (app *App) SetLinker(linker Linker, secret string) error {
+	if secret == "" {
+		return fmt.Errorf("A secret is required to link accounts")
+	}
+	salt, created, err := app.linkSalt()
+	if err != nil {
+		return err
+	}
+	aead, err := newAEAD(hkdfSHA256([]byte(secret), salt, []byte(link_key_info)))
+	if err != nil {
+		return err
+	}
+	app.links.mutex.Lock()
+	app.links.linker = linker
+	app.links.aead = aead
+	app.links.mutex.Unlock()
+	if created {
+		// Links made before there was a salt used the plain hash of the secret as key
+		legacy := sha256.Sum256([]byte(secret))
+		return app.reencryptLinks(legacy[:])
+	}
+	return nil
+}
+
+// Loads the salt of the key derivation, on first use a random one is created and stored.
+// Returns true if the salt was just created.
+func (app *App) linkSalt() ([]byte, bool, error) {
+	var salt []byte
+	err := app.db.QueryRow("SELECT salt FROM link_salt LIMIT 1").Scan(&salt)
+	if err == nil {
+		return salt, false, nil
+	}
+	if !errors.Is(err, sql.ErrNoRows) {
+		return nil, false, err
+	}
+	salt = make([]byte, link_salt_length)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, false, err
+	}
+	if _, err := app.db.Exec("INSERT INTO link_salt VALUES(?)", salt); err != nil {
+		return nil, false, fmt.Errorf("Error storing salt: %w", err)
+	}
+	return salt, true, nil
+}
+
+// Encrypts the stored credentials, which were encrypted with the old key, with the current one.
+// Credentials the old key can't decrypt are left alone, they ask to link again when used.
+func (app *App) reencryptLinks(old []byte) error {
+	legacy, err := newAEAD(old)
+	if err != nil {
+		return err
+	}
+	rows, err := app.db.Query("SELECT account, credential FROM linked_accounts")
+	if err != nil {
+		return err
+	}
+	credentials := make(map[string][]byte)
+	for rows.Next() {
+		var account string
+		var encrypted []byte
+		if err := rows.Scan(&account, &encrypted); err == nil {
+			credentials[account] = encrypted
+		}
+	}
+	rows.Close()
+	for account, encrypted := range credentials {
+		credential, err := decryptWith(legacy, encrypted)
+		if err != nil {
+			continue
+		}
+		reencrypted, err := app.encrypt(credential)
+		if err != nil {
+			return err
+		}
+		if _, err := app.db.Exec("UPDATE linked_accounts SET credential=? WHERE account=?", reencrypted, account); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Derives a 256 bit key as HKDF-SHA256 (RFC 5869). One block of output is all AES-256 needs
+func hkdfSHA256(secret []byte, salt []byte, info []byte) []byte {
+	extract := hmac.New(sha256.New, salt)
+	extract.Write(secret)
+	expand := hmac.New(sha256.New, extract.Sum(nil))
+	expand.Write(info)
+	expand.Write([]byte{1})
+	return expand.Sum(nil)
+}
+
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+func (app *App) linkingEnabled() bool {
+	app.links.mutex.Lock()
+	defer app.links.mutex.Unlock()
+	return app.links.linker != nil
+}
+
+// Returns the authenticated IRC account of the author of a message. Linking is bound to it, nicks are too easy to take.
+func (app *App) ircAccount(messageID MessageID) (string, error) {
+	account, err := app.ircAdapter.Account(messageID)
+	if err != nil {
+		return "", err
+	}
+	if account == "" {
+		return "", fmt.Errorf("You need to be identified (e.g. with NickServ) to use a linked account")
+	}
+	return strings.ToLower(account), nil
+}
+
+// Starts linking and returns the URL the user has to visit
+func (app *App) startLink(account string, instance string) (string, error) {
+	app.links.mutex.Lock()
+	linker := app.links.linker
+	app.links.mutex.Unlock()
+	authorize, state, err := linker.StartLink(instance)
+	if err != nil {
+		return "", err
+	}
+	app.links.mutex.Lock()
+	app.links.pending[account] = state
+	app.links.mutex.Unlock()
+	return authorize, nil
+}
+
+// Finishes linking with the authorization code, returns the name of the linked account
+func (app *App) finishLink(account string, code string) (string, error) {
+	app.links.mutex.Lock()
+	linker := app.links.linker
+	state, ok := app.links.pending[account]
+	app.links.mutex.Unlock()
+	if !ok {
+		return "", fmt.Errorf("No link started, start with .link [instance]")
+	}
+	credential, err := linker.FinishLink(state, code)
+	if err != nil {
+		return "", err
+	}
+	social, name, err := linker.Connect(credential)
+	if err != nil {
+		return "", err
+	}
+	encrypted, err := app.encrypt(credential)
+	if err != nil {
+		return "", err
+	}
+	if _, err := app.db.Exec("INSERT OR REPLACE INTO linked_accounts VALUES(?,?,?)", account, time.Now(), encrypted); err != nil {
+		return "", fmt.Errorf("Error storing linked account: %w", err)
+	}
+	app.links.mutex.Lock()
+	delete(app.links.pending, account)
+	app.links.connected[account] = linkedAccount{social: social, name: name}
+	app.links.mutex.Unlock()
+	return name, nil
+}
+
+func (app *App) unlink(account string) error {
+	app.links.mutex.Lock()
+	delete(app.links.connected, account)
+	delete(app.links.pending, account)
+	app.links.mutex.Unlock()
+	_, err := app.db.Exec("DELETE FROM linked_accounts WHERE account=?", account)
+	return err
+}
+
+// Returns the adapter of the account linked to the IRC account, connecting it on first use
+func (app *App) linkedAccount(account string) (SocialAdapter, string, error) {
+	app.links.mutex.Lock()
+	linker := app.links.linker
+	linked, ok := app.links.connected[account]
+	app.links.mutex.Unlock()
+	if linker == nil {
+		return nil, "", fmt.Errorf("Linking personal accounts is not enabled")
+	}
+	if ok {
+		return linked.social, linked.name, nil
+	}
+	row := app.db.QueryRow("SELECT credential FROM linked_accounts WHERE account=?", account)
+	var encrypted []byte
+	if err := row.Scan(&encrypted); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, "", fmt.Errorf("No linked account, link one via /query with .link [instance]")
+		}
+		return nil, "", err
+	}
+	credential, err := app.decrypt(encrypted)
+	if err != nil {
+		return nil, "", fmt.Errorf("Could not decrypt linked account, please link it again: %w", err)
+	}
+	social, name, err := linker.Connect(credential)
+	if err != nil {
+		return nil, "", err
+	}
+	app.links.mutex.Lock()
+	app.links.connected[account] = linkedAccount{social: social, name: name}
+	app.links.mutex.Unlock()
+	return social, name, nil
+}
+
+func (app *App) encrypt(plaintext string) ([]byte, error) {
+	nonce := make([]byte, app.links.aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return app.links.aead.Seal(nonce, nonce, []byte(plaintext), nil), nil
+}
+
+func (app *App) decrypt(ciphertext []byte) (string, error) {
+	return decryptWith(app.links.aead, ciphertext)
+}
+
+func decryptWith(aead cipher.AEAD, ciphertext []byte) (string, error) {
+	size := aead.NonceSize()
+	if len(ciphertext) < size {
+		return "", fmt.Errorf("Ciphertext too short")
+	}
+	plaintext, err := aead.Open(nil, ciphertext[:size], ciphertext[size:], nil)
+	return string(plaintext), err
+}
+
+// Commands only available via /query
+var direct_commands = []command{
+	{
+		name:                 "link",
+		description:          "Links your own Mastodon account to your IRC account. \".link [instance]\" starts, \".link code [code]\" finishes. Afterwards use commands with @me, e.g. .t@me",
+		nargs:                0,
+		elevated_permissions: false,
+		action: func(app *App, call invocation) {
+			if !app.linkingEnabled() {
+				app.ircAdapter.Reply(call.messageID, "Linking personal accounts is not enabled")
+				return
+			}
+			account, err := app.ircAccount(call.messageID)
+			if err != nil {
+				app.ircAdapter.Reply(call.messageID, err.Error())
+				return
+			}
+			args := strings.Fields(call.args)
+			switch {
+			case len(args) == 0:
+				_, name, err := app.linkedAccount(account)
+				if err != nil {
+					app.ircAdapter.Reply(call.messageID, err.Error())
+				} else {
+					app.ircAdapter.Reply(call.messageID, fmt.Sprintf("Your IRC account %s is linked to %s", account, name))
+				}
+			case len(args) == 2 && args[0] == "code":
+				name, err := app.finishLink(account, args[1])
+				if err != nil {
+					app.ircAdapter.Reply(call.messageID, fmt.Sprintf("Error linking account: %v", err))
+				} else {
+					app.ircAdapter.Reply(call.messageID, fmt.Sprintf("Linked %s. Use commands with @me to act as it, e.g. .t@me", name))
+				}
+			case len(args) == 1:
+				authorize, err := app.startLink(account, args[0])
+				if err != nil {
+					app.ircAdapter.Reply(call.messageID, fmt.Sprintf("Error starting link: %v", err))
+				} else {
+					app.ircAdapter.Reply(call.messageID, fmt.Sprintf("Open %s , authorize the bot and finish with .link code [code]", authorize))
+				}
+			default:
+				app.ircAdapter.Reply(call.messageID, "Usage: .link [instance] or .link code [code]")
+			}
+		},
+	}, {
+		name:                 "unlink",
+		description:          "Removes the link to your own Mastodon account",
+		nargs:                0,
+		elevated_permissions: false,
+		action: func(app *App, call invocation) {
+			account, err := app.ircAccount(call.messageID)
+			if err != nil {
+				app.ircAdapter.Reply(call.messageID, err.Error())
+				return
+			}
+			if err := app.unlink(account); err != nil {
+				app.ircAdapter.Reply(call.messageID, fmt.Sprintf("Error unlinking account: %v", err))
+			} else {
+				app.ircAdapter.Reply(call.messageID, "Unlinked your account")
+			}
+		},
+	},
+}
@@ -0,0 +1,120 @@
+package app
+
+import (
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Actions on accounts and reports for instance moderators
+type ModerationAction string
+
+const (
+	ModerationApprove ModerationAction = "approve"
+	ModerationReject  ModerationAction = "reject"
+	ModerationResolve ModerationAction = "resolve"
+	ModerationAssign  ModerationAction = "assign"
+	ModerationSilence ModerationAction = "silence"
+	ModerationSuspend ModerationAction = "suspend"
+)
+
+// Sign ups and reports are relayed to the moderation channel and only handled there
+type moderation struct {
+	mutex   sync.Mutex
+	channel string
+}
+
+// Sets the channel admin notifications are relayed to and moderation commands are accepted in
+func (app *App) SetModerationChannel(channel string) {
+	app.moderation.mutex.Lock()
+	defer app.moderation.mutex.Unlock()
+	app.moderation.channel = channel
+}
+
+func (app App) moderationChannel() string {
+	app.moderation.mutex.Lock()
+	defer app.moderation.mutex.Unlock()
+	return app.moderation.channel
+}
+
+// Relays admin notifications. Without a moderation channel they are dropped, they don't belong in the public channel
+func (app App) relayModeration(alias string, message string) {
+	channel := app.moderationChannel()
+	if channel == "" {
+		log.Println("No moderation channel configured, dropping:", message)
+		return
+	}
+	app.ircAdapter.SendTo(channel, app.tag(alias, message))
+}
+
+// Handles messages written in the moderation channel. Returns false if the message was written elsewhere.
+func (app *App) handleModeration(msgtype string, message string, messageID string) bool {
+	channel := app.moderationChannel()
+	if channel == "" || !strings.HasPrefix(msgtype, "channel.") {
+		return false
+	}
+	origin, err := app.ircAdapter.Origin(messageID)
+	if err != nil || !strings.EqualFold(origin, channel) {
+		return false
+	}
+	call, cmd, found := parseInvocation(moderation_command_map, msgtype, message, messageID)
+	if found && call.permitted(cmd) {
+		cmd.action(app, call)
+	}
+	return true
+}
+
+// Builds a command performing a moderation action on the id given as first parameter.
+// The action is attributed to the nick calling it, in the reply and (for account actions) on the instance.
+func moderationCommand(action ModerationAction, description string) command {
+	return command{
+		name:                 string(action),
+		description:          description,
+		nargs:                1,
+		elevated_permissions: true,
+		action: func(app *App, call invocation) {
+			id, text, _ := strings.Cut(call.args, " ")
+			social, alias, _, err := app.social(call, "")
+			if err != nil {
+				app.ircAdapter.Reply(call.messageID, err.Error())
+				return
+			}
+			nick, err := app.ircAdapter.Author(call.messageID)
+			if err != nil {
+				nick = "unknown"
+			}
+			text = strings.TrimSpace(fmt.Sprintf("%s (%s by %s via IRC)", text, action, nick))
+			if err := social.Moderate(action, id, text); err != nil {
+				app.relayModeration(alias, fmt.Sprintf("Error during %s of %s: %v", action, id, err))
+				return
+			}
+			log.Println("Moderation:", nick, "performed", action, "on", id)
+			app.relayModeration(alias, fmt.Sprintf("%s: %s %s", nick, action, id))
+		},
+	}
+}
+
+var moderation_commands = []command{
+	moderationCommand(ModerationApprove, "Approves a pending account. Parameter is the account id"),
+	moderationCommand(ModerationReject, "Rejects a pending account. Parameter is the account id"),
+	moderationCommand(ModerationResolve, "Resolves a report. Parameter is the report id"),
+	moderationCommand(ModerationAssign, "Assigns a report to the bot's account. Parameter is the report id"),
+	moderationCommand(ModerationSilence, "Limits an account. Parameter is the account id, everything after is the reason"),
+	moderationCommand(ModerationSuspend, "Suspends an account. Parameter is the account id, everything after is the reason"),
+	{
+		name:                 "?",
+		description:          "Lists the moderation commands",
+		nargs:                0,
+		elevated_permissions: false,
+		action: func(app *App, call invocation) {
+			descriptions := []string{}
+			for name, cmd := range moderation_command_map {
+				descriptions = append(descriptions, command_prefix+name+" "+cmd.description)
+			}
+			sort.Strings(descriptions)
+			app.ircAdapter.Reply(call.messageID, strings.Join(descriptions, "\n"))
+		},
+	},
+}
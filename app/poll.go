@@ -0,0 +1,96 @@
+package app
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Separates the toot text from the poll definition (and the poll settings from each other)
+const poll_separator = " || "
+const poll_option_separator = "|"
+const poll_default_duration = 24 * time.Hour
+
+// Polls are created with a duration in seconds, anything shorter would end right away
+var errPollTooShort = errors.New("A poll has to run for at least a second")
+
+// Parses toot messages with an optional poll appended, like:
+//
+//	Which day works best? || Monday | Tuesday | Friday || 2d || multiple
+//
+// After the text follow the options seperated by "|", then optionally the duration
+// (Go duration or a number of days like "2d") and "multiple" to allow several choices.
+// Returns a nil poll if the message contains none.
+func parsePoll(message string) (string, *Poll, error) {
+	parts := strings.Split(message, poll_separator)
+	if len(parts) == 1 {
+		return message, nil, nil
+	}
+	text := parts[0]
+	poll := Poll{
+		ExpiresIn: poll_default_duration,
+	}
+	for _, option := range strings.Split(parts[1], poll_option_separator) {
+		option = strings.TrimSpace(option)
+		if option != "" {
+			poll.Options = append(poll.Options, option)
+		}
+	}
+	if len(poll.Options) < 2 {
+		return "", nil, fmt.Errorf("A poll needs at least two options")
+	}
+	for _, setting := range parts[2:] {
+		setting = strings.TrimSpace(setting)
+		switch strings.ToLower(setting) {
+		case "multiple", "multi":
+			poll.Multiple = true
+		default:
+			duration, err := parsePollDuration(setting)
+			if errors.Is(err, errPollTooShort) {
+				return "", nil, err
+			}
+			if err != nil {
+				return "", nil, fmt.Errorf("Unknown poll setting '%s'", setting)
+			}
+			poll.ExpiresIn = duration
+		}
+	}
+	return text, &poll, nil
+}
+
+// Like time.ParseDuration but also accepts days ("3d"). Durations shorter than a second are refused,
+// the limits of the instance are checked by the SocialAdapter
+func parsePollDuration(duration string) (time.Duration, error) {
+	var parsed time.Duration
+	if days, found := strings.CutSuffix(duration, "d"); found {
+		n, err := strconv.Atoi(days)
+		if err != nil {
+			return 0, err
+		}
+		parsed = time.Duration(n) * 24 * time.Hour
+	} else {
+		var err error
+		if parsed, err = time.ParseDuration(duration); err != nil {
+			return 0, err
+		}
+	}
+	if parsed < time.Second {
+		return 0, errPollTooShort
+	}
+	return parsed, nil
+}
+
+// Parses the (1-based, as shown in IRC) option numbers of a vote to the 0-based indices used by SocialAdapter.Vote
+func parseVoteChoices(choices []string) ([]int, error) {
+	var parsed []int
+	for _, choice := range choices {
+		n, err := strconv.Atoi(choice)
+		if err != nil || n < 1 {
+			return nil, fmt.Errorf("'%s' is not an option number", choice)
+		}
+		parsed = append(parsed, n-1)
+	}
+	return parsed, nil
+}
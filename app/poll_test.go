@@ -0,0 +1,79 @@
+package app
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParsePollDuration(t *testing.T) {
+	tests := []struct {
+		name     string
+		duration string
+		want     time.Duration
+		wantErr  bool
+	}{
+		{"days", "2d", 48 * time.Hour, false},
+		{"go duration", "90m", 90 * time.Minute, false},
+		{"combined go duration", "1h30m", 90 * time.Minute, false},
+		{"one second", "1s", time.Second, false},
+		{"zero", "0s", 0, true},
+		{"zero days", "0d", 0, true},
+		{"negative", "-1h", 0, true},
+		{"negative days", "-2d", 0, true},
+		{"below a second", "500ms", 0, true},
+		{"fractional days", "1.5d", 0, true},
+		{"no unit", "5", 0, true},
+		{"garbage", "soon", 0, true},
+		{"empty", "", 0, true},
+	}
+	for _, test := range tests {
+		got, err := parsePollDuration(test.duration)
+		if (err != nil) != test.wantErr {
+			t.Errorf("%s: parsePollDuration(%q) error = %v, want error %t", test.name, test.duration, err, test.wantErr)
+			continue
+		}
+		if got != test.want {
+			t.Errorf("%s: parsePollDuration(%q) = %s, want %s", test.name, test.duration, got, test.want)
+		}
+	}
+}
+
+func TestParsePoll(t *testing.T) {
+	tests := []struct {
+		name     string
+		message  string
+		text     string
+		options  int
+		duration time.Duration
+		multiple bool
+		wantErr  bool
+	}{
+		{"no poll", "Hello world", "Hello world", 0, 0, false, false},
+		{"defaults", "Which day? || Mon | Tue", "Which day?", 2, poll_default_duration, false, false},
+		{"all settings", "Which day? || Mon | Tue | Fri || 2d || multiple", "Which day?", 3, 48 * time.Hour, true, false},
+		{"empty options ignored", "Which? || a | | b", "Which?", 2, poll_default_duration, false, false},
+		{"one option", "Which? || a", "", 0, 0, false, true},
+		{"unknown setting", "Which? || a | b || sometimes", "", 0, 0, false, true},
+		{"zero duration", "Which? || a | b || 0d", "", 0, 0, false, true},
+	}
+	for _, test := range tests {
+		text, poll, err := parsePoll(test.message)
+		if (err != nil) != test.wantErr {
+			t.Errorf("%s: parsePoll(%q) error = %v, want error %t", test.name, test.message, err, test.wantErr)
+			continue
+		}
+		if text != test.text {
+			t.Errorf("%s: parsePoll(%q) text = %q, want %q", test.name, test.message, text, test.text)
+		}
+		if poll == nil {
+			if test.options > 0 {
+				t.Errorf("%s: parsePoll(%q) found no poll", test.name, test.message)
+			}
+			continue
+		}
+		if len(poll.Options) != test.options || poll.ExpiresIn != test.duration || poll.Multiple != test.multiple {
+			t.Errorf("%s: parsePoll(%q) = %d options, %s, multiple %t, want %d options, %s, multiple %t", test.name, test.message,
+				len(poll.Options), poll.ExpiresIn, poll.Multiple, test.options, test.duration, test.multiple)
+		}
+	}
+}
@@ -0,0 +1,118 @@
+package app
+
+import (
+	"log"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+const create_table_preview_optout = `
+  CREATE TABLE IF NOT EXISTS preview_optout(
+    user TEXT NOT NULL PRIMARY KEY
+  );
+`
+
+// Minimum time between previews of two messages in the channel and between two previews of the same link
+const preview_interval = 30 * time.Second
+const preview_repeat_interval = 15 * time.Minute
+
+// Only the first few links of a message are previewed, nobody wants a wall of toots
+const preview_max_links = 2
+
+// Matches the common permalink formats of fediverse posts:
+// Mastodon (/@user/id, /@user@remote/id, /users/user/statuses/id), Pleroma/Akkoma (/notice/id, /objects/uuid)
+// and GoToSocial (/@user/statuses/id)
+var tootLinkRegex = regexp.MustCompile(`https?://[a-zA-Z0-9.-]+(:[0-9]+)?/(@[\w.-]+(@[a-zA-Z0-9.-]+)?/(statuses/)?[0-9A-Za-z]+|users/[\w.-]+/statuses/[0-9A-Za-z]+|notice/[0-9A-Za-z]+|objects/[0-9a-fA-F-]+)`)
+
+type previewLimiter struct {
+	mutex    sync.Mutex
+	last     time.Time
+	previews map[string]time.Time
+}
+
+func newPreviewLimiter() *previewLimiter {
+	return &previewLimiter{
+		previews: make(map[string]time.Time),
+	}
+}
+
+// Returns the links of a message which may be previewed now: none if the channel saw a preview less than
+// preview_interval ago, otherwise those not previewed recently. Nothing is recorded, see record.
+func (pl *previewLimiter) allowed(links []string) []string {
+	pl.mutex.Lock()
+	defer pl.mutex.Unlock()
+	now := time.Now()
+	if now.Sub(pl.last) < preview_interval {
+		return nil
+	}
+	var allowed []string
+	for _, link := range links {
+		if last, ok := pl.previews[link]; !ok || now.Sub(last) >= preview_repeat_interval {
+			allowed = append(allowed, link)
+		}
+	}
+	return allowed
+}
+
+// Records a successful preview. The interval starts with the last preview of a message
+func (pl *previewLimiter) record(link string) {
+	pl.mutex.Lock()
+	defer pl.mutex.Unlock()
+	now := time.Now()
+	// Forget old previews so the map does not grow forever
+	for l, t := range pl.previews {
+		if now.Sub(t) >= preview_repeat_interval {
+			delete(pl.previews, l)
+		}
+	}
+	pl.last = now
+	pl.previews[link] = now
+}
+
+// Looks for toot links in a channel message and posts a rendering (including the message key) of the toots to the channel.
+// Users who opted out via the command do not trigger previews.
+func (app *App) previewLinks(message string, messageID string) {
+	links := tootLinkRegex.FindAllString(message, preview_max_links)
+	if len(links) == 0 {
+		return
+	}
+	author, err := app.ircAdapter.Author(messageID)
+	if err != nil {
+		log.Println("Could not get author for link preview:", err)
+		return
+	}
+	if app.previewOptedOut(author) {
+		return
+	}
+	// The limit applies per message, so all links of a message get their preview
+	for _, link := range app.previews.allowed(links) {
+		tootMessage, err := app.defaultAccount().Search(link)
+		if err != nil {
+			// Not every link that looks like a toot is one. No need to bother the channel with that
+			log.Println("Could not resolve link for preview:", link, err)
+			continue
+		}
+		app.previews.record(link)
+		app.ircAdapter.Send(tootMessage)
+	}
+}
+
+func (app *App) previewOptedOut(user string) bool {
+	user = strings.ToLower(user)
+	row := app.db.QueryRow("SELECT user FROM preview_optout WHERE user=?", user)
+	var found string
+	return row.Scan(&found) == nil
+}
+
+// Toggles the link preview opt out for a user. Returns true if the user is now opted out.
+func (app *App) togglePreviewOptOut(user string) (bool, error) {
+	user = strings.ToLower(user)
+	if app.previewOptedOut(user) {
+		_, err := app.db.Exec("DELETE FROM preview_optout WHERE user=?", user)
+		return false, err
+	}
+	_, err := app.db.Exec("INSERT INTO preview_optout VALUES(?)", user)
+	return true, err
+}
@@ -0,0 +1,203 @@
+package app
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+	"sync"
+)
+
+type ProfileField struct {
+	Name  string
+	Value string
+}
+
+// The editable parts of an account profile. Avatar and Header are URLs of the images
+type Profile struct {
+	DisplayName string
+	Note        string
+	Fields      []ProfileField
+	Avatar      string
+	Header      string
+}
+
+// Profile changes are previewed and need to be confirmed before they are applied. Changes are
+// collected per account until confirmed or cancelled.
+type profileChanges struct {
+	mutex   sync.Mutex
+	pending map[string]*pendingProfile
+}
+
+type pendingProfile struct {
+	current Profile
+	changed Profile
+	// Everybody who changed something, in order
+	authors []string
+}
+
+// Describes the differences between two profiles, one line per change
+func (p Profile) diff(changed Profile) []string {
+	var lines []string
+	if p.DisplayName != changed.DisplayName {
+		lines = append(lines, fmt.Sprintf("Display name: '%s' -> '%s'", p.DisplayName, changed.DisplayName))
+	}
+	if p.Note != changed.Note {
+		lines = append(lines, fmt.Sprintf("Bio: '%s' -> '%s'", p.Note, changed.Note))
+	}
+	old := make(map[string]string)
+	for _, field := range p.Fields {
+		old[field.Name] = field.Value
+	}
+	for _, field := range changed.Fields {
+		value, existed := old[field.Name]
+		if !existed {
+			lines = append(lines, fmt.Sprintf("New field '%s': '%s'", field.Name, field.Value))
+		} else if value != field.Value {
+			lines = append(lines, fmt.Sprintf("Field '%s': '%s' -> '%s'", field.Name, value, field.Value))
+		}
+		delete(old, field.Name)
+	}
+	for name := range old {
+		lines = append(lines, fmt.Sprintf("Removed field '%s'", name))
+	}
+	if p.Avatar != changed.Avatar {
+		lines = append(lines, fmt.Sprintf("Avatar: %s", changed.Avatar))
+	}
+	if p.Header != changed.Header {
+		lines = append(lines, fmt.Sprintf("Header: %s", changed.Header))
+	}
+	return lines
+}
+
+// Applies one change as given to the profile command, e.g. "name Hackspace" or "field Space status=open"
+func (p *Profile) apply(change string) error {
+	what, value, _ := strings.Cut(change, " ")
+	value = strings.TrimSpace(value)
+	switch what {
+	case "name":
+		p.DisplayName = value
+	case "bio":
+		p.Note = strings.ReplaceAll(value, `\n`, "\n")
+	case "avatar":
+		p.Avatar = value
+	case "header":
+		p.Header = value
+	case "field":
+		name, fieldValue, found := strings.Cut(value, "=")
+		if !found || strings.TrimSpace(name) == "" {
+			return fmt.Errorf("Fields are given as name=value, an empty value removes the field")
+		}
+		p.setField(strings.TrimSpace(name), strings.TrimSpace(fieldValue))
+	default:
+		return fmt.Errorf("Unknown profile part '%s', use name, bio, field, avatar or header", what)
+	}
+	return nil
+}
+
+// Sets the field with the given name, an empty value removes it
+func (p *Profile) setField(name string, value string) {
+	fields := []ProfileField{}
+	found := false
+	for _, field := range p.Fields {
+		if field.Name != name {
+			fields = append(fields, field)
+		} else if value != "" {
+			fields = append(fields, ProfileField{Name: name, Value: value})
+			found = true
+		}
+	}
+	if !found && value != "" {
+		fields = append(fields, ProfileField{Name: name, Value: value})
+	}
+	p.Fields = fields
+}
+
+func (p Profile) describe() string {
+	lines := []string{
+		fmt.Sprintf("Display name: %s", p.DisplayName),
+		fmt.Sprintf("Bio: %s", strings.ReplaceAll(p.Note, "\n", " / ")),
+	}
+	for _, field := range p.Fields {
+		lines = append(lines, fmt.Sprintf("%s: %s", field.Name, field.Value))
+	}
+	lines = append(lines, fmt.Sprintf("Avatar: %s", p.Avatar), fmt.Sprintf("Header: %s", p.Header))
+	return strings.Join(lines, "\n")
+}
+
+// Handles the profile command for the selected account
+func (app *App) profileCommand(call invocation) {
+	social, alias, _, err := app.social(call, "")
+	if err != nil {
+		app.ircAdapter.Reply(call.messageID, err.Error())
+		return
+	}
+	author, _ := app.ircAdapter.Author(call.messageID)
+	action := strings.Fields(call.args)
+	if len(action) == 0 {
+		profile, err := social.Profile()
+		if err != nil {
+			app.ircAdapter.Reply(call.messageID, fmt.Sprintf("Error getting profile: %v", err))
+			return
+		}
+		app.send(call, app.tag(alias, profile.describe()))
+		return
+	}
+
+	switch action[0] {
+	case "cancel":
+		app.profiles.mutex.Lock()
+		delete(app.profiles.pending, alias)
+		app.profiles.mutex.Unlock()
+		app.send(call, app.tag(alias, "Pending profile changes cancelled"))
+	case "confirm":
+		// Taken out under the lock, so concurrent changes either make it into this update or start anew
+		app.profiles.mutex.Lock()
+		pending := app.profiles.pending[alias]
+		delete(app.profiles.pending, alias)
+		app.profiles.mutex.Unlock()
+		if pending == nil {
+			app.ircAdapter.Reply(call.messageID, "No pending profile changes")
+			return
+		}
+		if err := social.UpdateProfile(pending.changed); err != nil {
+			app.send(call, fmt.Sprintf("Error updating profile: %v", err))
+		} else {
+			app.send(call, app.tag(alias, fmt.Sprintf("Profile updated (changes by %s, confirmed by %s)", strings.Join(pending.authors, ", "), author)))
+		}
+	default:
+		// The current profile is loaded without holding the lock. Changes started by somebody else meanwhile
+		// take precedence, they are based on the current profile as well
+		app.profiles.mutex.Lock()
+		pending := app.profiles.pending[alias]
+		if pending == nil {
+			app.profiles.mutex.Unlock()
+			current, err := social.Profile()
+			if err != nil {
+				app.ircAdapter.Reply(call.messageID, fmt.Sprintf("Error getting profile: %v", err))
+				return
+			}
+			app.profiles.mutex.Lock()
+			if pending = app.profiles.pending[alias]; pending == nil {
+				pending = &pendingProfile{current: current, changed: current}
+				pending.changed.Fields = append([]ProfileField{}, current.Fields...)
+			}
+		}
+		// apply changes nothing if it fails
+		if err := pending.changed.apply(call.args); err != nil {
+			app.profiles.mutex.Unlock()
+			app.ircAdapter.Reply(call.messageID, err.Error())
+			return
+		}
+		if !slices.Contains(pending.authors, author) {
+			pending.authors = append(pending.authors, author)
+		}
+		app.profiles.pending[alias] = pending
+		changes := pending.current.diff(pending.changed)
+		app.profiles.mutex.Unlock()
+		if len(changes) == 0 {
+			app.send(call, app.tag(alias, "No profile changes pending"))
+			return
+		}
+		app.send(call, app.tag(alias, "Pending profile changes:\n"+strings.Join(changes, "\n")+"\nApply with .profile confirm or discard with .profile cancel"))
+	}
+}
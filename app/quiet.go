@@ -0,0 +1,304 @@
+package app
+
+import (
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const create_table_quiet_queue = `
+  CREATE TABLE IF NOT EXISTS quiet_queue(
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    time DATETIME NOT NULL,
+    alias TEXT NOT NULL,
+    msgtype TEXT NOT NULL,
+    message TEXT NOT NULL,
+    messageid TEXT NOT NULL
+  );
+`
+
+// How often the schedule is checked for the end of quiet hours
+const quiet_check_interval = time.Minute
+
+// Notification types paused during quiet hours unless configured otherwise.
+// Direct messages and moderation don't go to the channel and are never paused
+var default_quiet_types = []string{"mention", "status", "poll", "favourite", "reblog", "update", "delete", "moin"}
+
+// A daily period of quiet, e.g. 22:00 to 07:00. Periods may span midnight
+type quietPeriod struct {
+	start time.Duration
+	end   time.Duration
+}
+
+// Pauses relaying into the channel during scheduled quiet hours or when switched on via command.
+// Paused notifications are queued in the database and summarized once the quiet ends.
+type quietHours struct {
+	mutex    sync.Mutex
+	schedule []quietPeriod
+	types    map[string]bool
+	// Mentions are relayed anyway
+	mentionsBreakThrough bool
+	// Set by the quiet command, overrides the schedule until the given time (zero: no override)
+	override      bool
+	overrideUntil time.Time
+	quiet         bool
+	// Held while summarizing, so concurrent summaries don't relay the same notifications twice
+	summarizing sync.Mutex
+}
+
+// Parses a schedule like "22:00-07:00" or "12:00-13:00,22:00-07:00"
+func parseQuietSchedule(schedule string) ([]quietPeriod, error) {
+	var periods []quietPeriod
+	for _, period := range strings.Split(schedule, ",") {
+		from, to, found := strings.Cut(strings.TrimSpace(period), "-")
+		if !found {
+			return nil, fmt.Errorf("Quiet hours are given as start-end, e.g. 22:00-07:00")
+		}
+		start, err := parseClock(from)
+		if err != nil {
+			return nil, err
+		}
+		end, err := parseClock(to)
+		if err != nil {
+			return nil, err
+		}
+		periods = append(periods, quietPeriod{start: start, end: end})
+	}
+	return periods, nil
+}
+
+// Time of day as offset from midnight
+func parseClock(clock string) (time.Duration, error) {
+	t, err := time.Parse("15:04", strings.TrimSpace(clock))
+	if err != nil {
+		return 0, fmt.Errorf("Invalid time of day %s, expected e.g. 07:30", clock)
+	}
+	return time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute, nil
+}
+
+func (p quietPeriod) contains(t time.Time) bool {
+	midnight := time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, t.Location())
+	offset := t.Sub(midnight)
+	if p.start <= p.end {
+		return offset >= p.start && offset < p.end
+	}
+	return offset >= p.start || offset < p.end
+}
+
+func (p quietPeriod) String() string {
+	clock := func(d time.Duration) string {
+		return fmt.Sprintf("%02d:%02d", int(d.Hours()), int(d.Minutes())%60)
+	}
+	return clock(p.start) + "-" + clock(p.end)
+}
+
+// Configures the quiet hours. types are the notification types paused, empty for the default ones.
+// With mentionsBreakThrough mentions are relayed even if paused.
+func (app *App) SetQuietHours(schedule string, types []string, mentionsBreakThrough bool) error {
+	periods, err := parseQuietSchedule(schedule)
+	if schedule != "" && err != nil {
+		return err
+	}
+	if len(types) == 0 {
+		types = default_quiet_types
+	}
+	app.quiet.mutex.Lock()
+	defer app.quiet.mutex.Unlock()
+	app.quiet.schedule = periods
+	app.quiet.types = typeSet(types)
+	app.quiet.mentionsBreakThrough = mentionsBreakThrough
+	return nil
+}
+
+func typeSet(types []string) map[string]bool {
+	set := make(map[string]bool)
+	for _, msgtype := range types {
+		set[strings.TrimSpace(msgtype)] = true
+	}
+	return set
+}
+
+// Whether it is quiet right now, the mutex must be held
+func (q *quietHours) isQuiet(now time.Time) bool {
+	if q.override {
+		if q.overrideUntil.IsZero() || now.Before(q.overrideUntil) {
+			return q.quiet
+		}
+		q.override = false
+	}
+	for _, period := range q.schedule {
+		if period.contains(now) {
+			return true
+		}
+	}
+	return false
+}
+
+// Whether notifications of the type are paused right now
+func (app App) paused(msgtype string) bool {
+	app.quiet.mutex.Lock()
+	defer app.quiet.mutex.Unlock()
+	if msgtype == "mention" && app.quiet.mentionsBreakThrough {
+		return false
+	}
+	return app.quiet.types[msgtype] && app.quiet.isQuiet(time.Now())
+}
+
+// Queues the notification if it is quiet and its type is paused. Returns true if it was queued.
+func (app App) queueIfQuiet(alias string, msgtype string, message string, messageID string) bool {
+	if !app.paused(msgtype) {
+		return false
+	}
+	if _, err := app.db.Exec("INSERT INTO quiet_queue(time, alias, msgtype, message, messageid) VALUES(?,?,?,?,?)", time.Now(), alias, msgtype, message, messageID); err != nil {
+		log.Println("Error queueing notification during quiet hours:", err)
+		return false
+	}
+	return true
+}
+
+// Watches the schedule and summarizes the queue once the quiet ends
+func (app App) runQuietHours() {
+	// Whatever was queued before a restart is summarized right away, unless it is still quiet
+	wasQuiet := true
+	for {
+		app.quiet.mutex.Lock()
+		quiet := app.quiet.isQuiet(time.Now())
+		app.quiet.mutex.Unlock()
+		if wasQuiet && !quiet {
+			app.summarizeQuiet()
+		}
+		wasQuiet = quiet
+		time.Sleep(quiet_check_interval)
+	}
+}
+
+// Relays a summary of everything queued and removes it from the queue
+func (app App) summarizeQuiet() {
+	app.quiet.summarizing.Lock()
+	defer app.quiet.summarizing.Unlock()
+	rows, err := app.db.Query("SELECT id, alias, msgtype, message, messageid FROM quiet_queue ORDER BY id")
+	if err != nil {
+		log.Println("Error reading the quiet queue:", err)
+		return
+	}
+	counts := make(map[string]int)
+	var lines []string
+	// Favourites and boosts are counted per toot instead of listed one by one
+	reactions := make(map[string]int)
+	var reacted []string
+	// Only what was read is removed, notifications queued meanwhile wait for the next summary
+	var last int64
+	for rows.Next() {
+		var id int64
+		var alias, msgtype, message, messageID string
+		if err := rows.Scan(&id, &alias, &msgtype, &message, &messageID); err != nil {
+			continue
+		}
+		last = id
+		counts[msgtype]++
+		switch msgtype {
+		case "mention", "status":
+			summary := ""
+			if social, found := app.accounts[alias]; found {
+				summary, _ = social.Summary(messageID)
+			}
+			lines = append(lines, app.tag(alias, fmt.Sprintf("%s [%s] %s", msgtype, messageID, summary)))
+		case "favourite", "reblog":
+			key := alias + "\x00" + msgtype + "\x00" + messageID
+			if reactions[key] == 0 {
+				reacted = append(reacted, key)
+			}
+			reactions[key]++
+		case "moin":
+			lines = append(lines, app.tag(alias, fmt.Sprintf("@%s sagt moin!", message)))
+		default:
+			lines = append(lines, app.tag(alias, strings.SplitN(message, "\n", 2)[0]))
+		}
+	}
+	rows.Close()
+	for _, key := range reacted {
+		parts := strings.SplitN(key, "\x00", 3)
+		lines = append(lines, app.tag(parts[0], fmt.Sprintf("%d× %s [%s]", reactions[key], parts[1], parts[2])))
+	}
+	if _, err := app.db.Exec("DELETE FROM quiet_queue WHERE id <= ?", last); err != nil {
+		log.Println("Error emptying the quiet queue:", err)
+	}
+	if len(counts) == 0 {
+		return
+	}
+	var summary []string
+	for msgtype, count := range counts {
+		summary = append(summary, fmt.Sprintf("%d %s", count, msgtype))
+	}
+	sort.Strings(summary)
+	app.ircAdapter.Send("Quiet hours are over. Meanwhile: " + strings.Join(summary, ", ") + "\n" + strings.Join(lines, "\n"))
+}
+
+// Handles the quiet command: "on" (optionally for a duration), "off" or nothing for the current state
+func (app *App) quietCommand(call invocation) {
+	action, duration, _ := strings.Cut(strings.TrimSpace(call.args), " ")
+	app.quiet.mutex.Lock()
+	switch action {
+	case "on":
+		until := time.Time{}
+		if duration != "" {
+			d, err := time.ParseDuration(strings.TrimSpace(duration))
+			if err != nil {
+				app.quiet.mutex.Unlock()
+				app.ircAdapter.Reply(call.messageID, fmt.Sprintf("Invalid duration %s, use e.g. 90m or 2h", duration))
+				return
+			}
+			until = time.Now().Add(d)
+		}
+		app.quiet.override, app.quiet.quiet, app.quiet.overrideUntil = true, true, until
+		app.quiet.mutex.Unlock()
+		if until.IsZero() {
+			app.ircAdapter.Send("Quiet until .quiet off")
+		} else {
+			app.ircAdapter.Send("Quiet until " + until.Format("15:04"))
+		}
+	case "off":
+		// Lasts until the next scheduled quiet hours start
+		next := app.quiet.nextStart(time.Now())
+		app.quiet.override, app.quiet.quiet, app.quiet.overrideUntil = true, false, next
+		app.quiet.mutex.Unlock()
+		app.summarizeQuiet()
+	case "":
+		quiet := app.quiet.isQuiet(time.Now())
+		var schedule []string
+		for _, period := range app.quiet.schedule {
+			schedule = append(schedule, period.String())
+		}
+		app.quiet.mutex.Unlock()
+		state := "Not quiet"
+		if quiet {
+			state = "Quiet"
+		}
+		if len(schedule) > 0 {
+			state += ", quiet hours: " + strings.Join(schedule, ", ")
+		}
+		app.ircAdapter.Reply(call.messageID, state)
+	default:
+		app.quiet.mutex.Unlock()
+		app.ircAdapter.Reply(call.messageID, "Use .quiet on [duration], .quiet off or .quiet")
+	}
+}
+
+// The next time a scheduled quiet period starts, zero if there is no schedule. The mutex must be held
+func (q *quietHours) nextStart(now time.Time) time.Time {
+	var next time.Time
+	midnight := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, now.Location())
+	for _, period := range q.schedule {
+		start := midnight.Add(period.start)
+		if !start.After(now) {
+			start = start.AddDate(0, 0, 1)
+		}
+		if next.IsZero() || start.Before(next) {
+			next = start
+		}
+	}
+	return next
+}
@@ -0,0 +1,68 @@
+package app
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestParseQuietSchedule(t *testing.T) {
+	tests := []struct {
+		name     string
+		schedule string
+		want     []quietPeriod
+		wantErr  bool
+	}{
+		{"one period", "12:00-13:30", []quietPeriod{{12 * time.Hour, 13*time.Hour + 30*time.Minute}}, false},
+		{"over midnight", "22:00-07:00", []quietPeriod{{22 * time.Hour, 7 * time.Hour}}, false},
+		{"several periods with spaces", "12:00-13:00, 22:00 - 07:00", []quietPeriod{{12 * time.Hour, 13 * time.Hour}, {22 * time.Hour, 7 * time.Hour}}, false},
+		{"single digit hour", "7:05-8:00", []quietPeriod{{7*time.Hour + 5*time.Minute, 8 * time.Hour}}, false},
+		{"no end", "22:00", nil, true},
+		{"invalid hour", "25:00-07:00", nil, true},
+		{"invalid minute", "22:60-07:00", nil, true},
+		{"not a time", "late-early", nil, true},
+		{"empty", "", nil, true},
+	}
+	for _, test := range tests {
+		got, err := parseQuietSchedule(test.schedule)
+		if (err != nil) != test.wantErr {
+			t.Errorf("%s: parseQuietSchedule(%q) error = %v, want error %t", test.name, test.schedule, err, test.wantErr)
+			continue
+		}
+		if err == nil && !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%s: parseQuietSchedule(%q) = %v, want %v", test.name, test.schedule, got, test.want)
+		}
+	}
+}
+
+func TestQuietPeriodContains(t *testing.T) {
+	day := time.Date(2024, 3, 10, 0, 0, 0, 0, time.UTC)
+	at := func(hour int, minute int) time.Time {
+		return day.Add(time.Duration(hour)*time.Hour + time.Duration(minute)*time.Minute)
+	}
+	lunch := quietPeriod{12 * time.Hour, 13 * time.Hour}
+	night := quietPeriod{22 * time.Hour, 7 * time.Hour}
+	tests := []struct {
+		name   string
+		period quietPeriod
+		t      time.Time
+		want   bool
+	}{
+		{"before", lunch, at(11, 59), false},
+		{"start is included", lunch, at(12, 0), true},
+		{"within", lunch, at(12, 30), true},
+		{"end is excluded", lunch, at(13, 0), false},
+		{"over midnight, evening", night, at(23, 0), true},
+		{"over midnight, start", night, at(22, 0), true},
+		{"over midnight, after midnight", night, at(0, 0), true},
+		{"over midnight, morning", night, at(6, 59), true},
+		{"over midnight, end", night, at(7, 0), false},
+		{"over midnight, day", night, at(15, 0), false},
+		{"empty period", quietPeriod{8 * time.Hour, 8 * time.Hour}, at(8, 0), false},
+	}
+	for _, test := range tests {
+		if got := test.period.contains(test.t); got != test.want {
+			t.Errorf("%s: %s contains %s = %t, want %t", test.name, test.period, test.t.Format("15:04"), got, test.want)
+		}
+	}
+}
@@ -0,0 +1,157 @@
+package irc
+
+import (
+	"log"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// The IRCv3 capabilities we request if the server offers them
+var wanted_caps = []string{"message-tags", "server-time", "account-tag", "extended-join", "multi-prefix", "away-notify", "cap-notify"}
+
+// State of the capability negotiation (CAP LS 302, REQ, END) and the capabilities in use
+type capabilities struct {
+	mutex sync.Mutex
+	// Offered by the server, with their values (e.g. the mechanisms of sasl)
+	available map[string]string
+	enabled   map[string]bool
+	// Whether CAP END was sent, capabilities changing afterwards come via cap-notify
+	ended bool
+	// SASL is in progress (CAP END waits for it) or succeeded
+	authenticating bool
+	authenticated  bool
+}
+
+func newCapabilities() *capabilities {
+	return &capabilities{
+		available: make(map[string]string),
+		enabled:   make(map[string]bool),
+	}
+}
+
+// Whether the capability was negotiated. Handlers use this to rely on tags or extended replies
+func (c *IrcClient) HasCap(name string) bool {
+	c.caps.mutex.Lock()
+	defer c.caps.mutex.Unlock()
+	return c.caps.enabled[name]
+}
+
+// The negotiated capabilities, sorted
+func (c *IrcClient) Capabilities() []string {
+	c.caps.mutex.Lock()
+	defer c.caps.mutex.Unlock()
+	var enabled []string
+	for name, on := range c.caps.enabled {
+		if on {
+			enabled = append(enabled, name)
+		}
+	}
+	sort.Strings(enabled)
+	return enabled
+}
+
+// Parses a capability list like "sasl=PLAIN,EXTERNAL server-time" into names and values
+func parseCaps(list string) map[string]string {
+	caps := make(map[string]string)
+	for _, cap := range strings.Fields(list) {
+		name, value, _ := strings.Cut(cap, "=")
+		caps[name] = value
+	}
+	return caps
+}
+
+// The wanted capabilities among the offered ones that are not enabled yet
+func (caps *capabilities) requestable(offered map[string]string) []string {
+	var request []string
+	for _, name := range wanted_caps {
+		if _, ok := offered[name]; ok && !caps.enabled[name] {
+			request = append(request, name)
+		}
+	}
+	return request
+}
+
+// Starts the negotiation, sent before NICK and USER. Servers without capability support ignore it
+func (c *IrcClient) startNegotiation() {
+	c.caps.mutex.Lock()
+	c.caps.available = make(map[string]string)
+	c.caps.enabled = make(map[string]bool)
+	c.caps.ended = false
+	c.caps.authenticating = false
+	c.caps.authenticated = false
+	c.caps.mutex.Unlock()
+	c.sendPriority("CAP LS 302")
+}
+
+// Handles the subcommands of CAP replies
+func (c *IrcClient) handleCap(subcommand string, more bool, list string) {
+	// Sent once the mutex is released (deferred functions run in reverse order)
+	var lines []string
+	defer func() { c.sendPriority(lines...) }()
+	c.caps.mutex.Lock()
+	defer c.caps.mutex.Unlock()
+	switch subcommand {
+	case "LS":
+		for name, value := range parseCaps(list) {
+			c.caps.available[name] = value
+		}
+		if more || c.caps.ended {
+			// Multiline replies (LS 302) end with a line without "*"
+			return
+		}
+		request := c.caps.requestable(c.caps.available)
+		if mechanisms, offered := c.caps.available["sasl"]; offered && c.wantsSASL(mechanisms) {
+			request = append(request, "sasl")
+		}
+		if len(request) > 0 {
+			lines = append(lines, "CAP REQ :"+strings.Join(request, " "))
+		} else {
+			lines = c.endNegotiation()
+		}
+	case "ACK":
+		for name := range parseCaps(list) {
+			if strings.HasPrefix(name, "-") {
+				delete(c.caps.enabled, name[1:])
+			} else {
+				c.caps.enabled[name] = true
+			}
+		}
+		log.Println("IRC capabilities enabled:", list)
+		if c.caps.enabled["sasl"] && !c.caps.ended && !c.caps.authenticating {
+			// CAP END is sent once SASL is done (see saslResult)
+			c.caps.authenticating = true
+			lines = append(lines, "AUTHENTICATE "+c.saslMechanism)
+			return
+		}
+		lines = c.endNegotiation()
+	case "NAK":
+		log.Println("IRC capabilities refused:", list)
+		lines = c.endNegotiation()
+	case "NEW":
+		// cap-notify: capabilities offered after registration
+		offered := parseCaps(list)
+		for name, value := range offered {
+			c.caps.available[name] = value
+		}
+		if request := c.caps.requestable(offered); len(request) > 0 {
+			lines = append(lines, "CAP REQ :"+strings.Join(request, " "))
+		}
+	case "DEL":
+		for name := range parseCaps(list) {
+			delete(c.caps.available, name)
+			delete(c.caps.enabled, name)
+		}
+		log.Println("IRC capabilities removed by server:", list)
+	}
+}
+
+// Ends the negotiation, later ACKs (after cap-notify) don't end it again. Returns CAP END for the caller to send
+// after releasing the mutex, which must be held
+func (c *IrcClient) endNegotiation() []string {
+	if c.caps.ended {
+		return nil
+	}
+	c.caps.ended = true
+	return []string{"CAP END"}
+}
@@ -0,0 +1,169 @@
+package irc
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"golang.org/x/net/proxy"
+)
+
+const DIAL_TIMEOUT = 30 * time.Second
+
+// How the connection to the server is made, see the setters below. The zero value dials with TLS
+// verified against the system roots, over IPv4 or IPv6.
+type dialOptions struct {
+	plaintext bool
+	roots     *x509.CertPool
+	// SHA-256 fingerprint of the server certificate, replaces the verification against CAs
+	fingerprint []byte
+	// SOCKS5 proxy address (host:port), e.g. Tor at localhost:9050
+	proxy string
+	// "tcp", "tcp4" or "tcp6"
+	network string
+}
+
+// Connects without TLS. Only meant for local test servers or connections through a trusted tunnel
+func (c *IrcClient) SetPlaintext(plaintext bool) {
+	c.dialing.plaintext = plaintext
+}
+
+// Verifies the server certificate against the CAs in the PEM file in addition to the system roots
+func (c *IrcClient) SetCA(caFile string) error {
+	pem, err := os.ReadFile(caFile)
+	if err != nil {
+		return fmt.Errorf("Could not read CA bundle: %w", err)
+	}
+	pool, err := x509.SystemCertPool()
+	if err != nil {
+		pool = x509.NewCertPool()
+	}
+	if !pool.AppendCertsFromPEM(pem) {
+		return fmt.Errorf("No certificates found in CA bundle %s", caFile)
+	}
+	c.dialing.roots = pool
+	return nil
+}
+
+// Pins the server certificate by its SHA-256 fingerprint (hex, colons allowed). The pinned certificate
+// is accepted even if self signed or expired, anything else is refused.
+func (c *IrcClient) PinCertificate(fingerprint string) error {
+	decoded, err := hex.DecodeString(strings.ReplaceAll(fingerprint, ":", ""))
+	if err != nil || len(decoded) != sha256.Size {
+		return fmt.Errorf("Invalid certificate fingerprint %s, expected a SHA-256 hash in hex", fingerprint)
+	}
+	c.dialing.fingerprint = decoded
+	return nil
+}
+
+// Connects through a SOCKS5 proxy, given as host:port or socks5://[user:password@]host:port.
+// The server name is resolved by the proxy, so .onion addresses work with Tor.
+func (c *IrcClient) SetProxy(address string) error {
+	if address != "" && !strings.Contains(address, "://") {
+		address = "socks5://" + address
+	}
+	if address != "" {
+		parsed, err := url.Parse(address)
+		if err != nil || parsed.Scheme != "socks5" && parsed.Scheme != "socks5h" {
+			return fmt.Errorf("Invalid proxy %s, only SOCKS5 is supported", address)
+		}
+	}
+	c.dialing.proxy = address
+	return nil
+}
+
+// Restricts the connection to IPv4 ("4") or IPv6 ("6"), empty allows both
+func (c *IrcClient) SetAddressFamily(family string) error {
+	switch strings.TrimPrefix(strings.ToLower(family), "ipv") {
+	case "":
+		c.dialing.network = "tcp"
+	case "4":
+		c.dialing.network = "tcp4"
+	case "6":
+		c.dialing.network = "tcp6"
+	default:
+		return fmt.Errorf("Unknown address family %s, use 4 or 6", family)
+	}
+	return nil
+}
+
+// Opens the connection to the configured server
+func (c *IrcClient) dial() (net.Conn, error) {
+	network := c.dialing.network
+	if network == "" {
+		network = "tcp"
+	}
+	var dialer proxy.ContextDialer = &net.Dialer{Timeout: DIAL_TIMEOUT}
+	if c.dialing.proxy != "" {
+		proxyURL, err := url.Parse(c.dialing.proxy)
+		if err != nil {
+			return nil, err
+		}
+		proxyDialer, err := proxy.FromURL(proxyURL, &net.Dialer{Timeout: DIAL_TIMEOUT})
+		if err != nil {
+			return nil, fmt.Errorf("Could not use proxy: %w", err)
+		}
+		contextDialer, ok := proxyDialer.(proxy.ContextDialer)
+		if !ok {
+			return nil, fmt.Errorf("Proxy %s does not support timeouts", c.dialing.proxy)
+		}
+		dialer = contextDialer
+	}
+	address := c.address
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		// No port given, use the default one
+		host = address
+		port := "6697"
+		if c.dialing.plaintext {
+			port = "6667"
+		}
+		address = net.JoinHostPort(host, port)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), DIAL_TIMEOUT)
+	defer cancel()
+	conn, err := dialer.DialContext(ctx, network, address)
+	if err != nil {
+		return nil, err
+	}
+	if c.dialing.plaintext {
+		return conn, nil
+	}
+	config := &tls.Config{
+		ServerName: host,
+		RootCAs:    c.dialing.roots,
+	}
+	if c.certificate != nil {
+		config.Certificates = []tls.Certificate{*c.certificate}
+	}
+	if c.dialing.fingerprint != nil {
+		// The pin replaces the CA verification
+		config.InsecureSkipVerify = true
+		config.VerifyConnection = c.verifyPin
+	}
+	tlsConn := tls.Client(conn, config)
+	if err := tlsConn.HandshakeContext(ctx); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return tlsConn, nil
+}
+
+func (c *IrcClient) verifyPin(state tls.ConnectionState) error {
+	if len(state.PeerCertificates) == 0 {
+		return fmt.Errorf("Server presented no certificate")
+	}
+	fingerprint := sha256.Sum256(state.PeerCertificates[0].Raw)
+	if !strings.EqualFold(hex.EncodeToString(fingerprint[:]), hex.EncodeToString(c.dialing.fingerprint)) {
+		return fmt.Errorf("Server certificate %x does not match the pinned fingerprint", fingerprint)
+	}
+	return nil
+}
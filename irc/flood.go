@@ -0,0 +1,135 @@
+package irc
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Default flood control: a burst of lines, afterwards one line per interval
+const FLOOD_BURST = 5
+const FLOOD_INTERVAL = time.Second
+
+// Outputs longer than this many lines are paginated, the rest is sent on MORE_COMMAND
+const PAGE_LINES = 10
+const MORE_COMMAND = ".more"
+
+// Token bucket pacing the outgoing lines. Every line takes a token, tokens refill one per interval up to burst
+type floodControl struct {
+	mutex    sync.Mutex
+	burst    int
+	interval time.Duration
+	tokens   float64
+	last     time.Time
+}
+
+// Output waiting for MORE_COMMAND, by destination
+type pager struct {
+	mutex   sync.Mutex
+	lines   int
+	pending map[string][]string
+}
+
+func newFloodControl(burst int, interval time.Duration) *floodControl {
+	return &floodControl{burst: burst, interval: interval, tokens: float64(burst), last: time.Now()}
+}
+
+func (f *floodControl) refill(now time.Time) {
+	if f.interval > 0 {
+		f.tokens += float64(now.Sub(f.last)) / float64(f.interval)
+	}
+	if f.tokens > float64(f.burst) || f.interval <= 0 {
+		f.tokens = float64(f.burst)
+	}
+	f.last = now
+}
+
+// Takes a token if there is one, otherwise returns how long to wait for the next one
+func (f *floodControl) take() time.Duration {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	f.refill(time.Now())
+	if f.tokens >= 1 {
+		f.tokens--
+		return 0
+	}
+	return time.Duration((1 - f.tokens) * float64(f.interval))
+}
+
+// Accounts for a line sent without waiting (protocol replies), it still counts against the server's limit
+func (f *floodControl) spend() {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	f.refill(time.Now())
+	if f.tokens > 0 {
+		f.tokens--
+	}
+}
+
+// Configures the flood control: burst lines are sent right away, afterwards one line per interval.
+// An interval of 0 disables the pacing
+func (c *IrcClient) SetFloodControl(burst int, interval time.Duration) {
+	if burst < 1 {
+		burst = 1
+	}
+	c.flood.mutex.Lock()
+	defer c.flood.mutex.Unlock()
+	c.flood.burst = burst
+	c.flood.interval = interval
+	c.flood.tokens = float64(burst)
+}
+
+// Sets the number of lines sent at once before the rest waits for MORE_COMMAND, 0 disables pagination
+func (c *IrcClient) SetPageLength(lines int) {
+	c.pages.mutex.Lock()
+	defer c.pages.mutex.Unlock()
+	c.pages.lines = lines
+}
+
+// Splits off the first page if the lines exceed the page length, the rest waits for MORE_COMMAND and replaces
+// whatever was waiting for the destination before. Shorter outputs (e.g. relayed notifications) leave an outstanding
+// rest alone. Returns the lines to send now and how many wait
+func (c *IrcClient) paginate(destination string, lines []string) ([]string, int) {
+	c.pages.mutex.Lock()
+	defer c.pages.mutex.Unlock()
+	if c.pages.lines <= 0 || len(lines) <= c.pages.lines {
+		return lines, 0
+	}
+	rest := lines[c.pages.lines:]
+	c.pages.pending[strings.ToLower(destination)] = rest
+	return lines[:c.pages.lines], len(rest)
+}
+
+// Sends the next page of output to the destination
+func (c *IrcClient) sendMore(destination string) {
+	c.pages.mutex.Lock()
+	key := strings.ToLower(destination)
+	pending := c.pages.pending[key]
+	delete(c.pages.pending, key)
+	c.pages.mutex.Unlock()
+	if len(pending) == 0 {
+		c.outgoing <- c.command(destination) + " " + destination + " :Nothing more to show"
+		return
+	}
+	lines, left := c.paginate(destination, pending)
+	c.queue(destination, lines, left)
+}
+
+// Sends lines to the destination and, if something is left, tells how to get the rest
+func (c *IrcClient) queue(destination string, lines []string, left int) {
+	for _, line := range lines {
+		c.outgoing <- line
+	}
+	if left > 0 {
+		c.outgoing <- fmt.Sprintf("%s %s :[%d more lines, send %s to continue]", c.command(destination), destination, left, MORE_COMMAND)
+	}
+}
+
+// Channels get NOTICE, nicks PRIVMSG
+func (c *IrcClient) command(destination string) string {
+	if strings.HasPrefix(destination, "#") {
+		return "NOTICE"
+	}
+	return "PRIVMSG"
+}
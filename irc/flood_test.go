@@ -0,0 +1,29 @@
+package irc
+
+import (
+	"reflect"
+	"testing"
+)
+
+// A short output (e.g. a relayed notification) in between must not discard the pages waiting for MORE_COMMAND
+func TestPaginationSurvivesShortOutput(t *testing.T) {
+	client := newTestClient(t)
+	client.SetPageLength(2)
+	lines, left := client.paginate("#chan", []string{"1", "2", "3", "4", "5"})
+	if !reflect.DeepEqual(lines, []string{"1", "2"}) || left != 3 {
+		t.Fatalf("first page %v with %d left, want [1 2] with 3 left", lines, left)
+	}
+	lines, left = client.paginate("#Chan", []string{"notification"})
+	if !reflect.DeepEqual(lines, []string{"notification"}) || left != 0 {
+		t.Fatalf("short output gave %v with %d left", lines, left)
+	}
+	client.sendMore("#chan")
+	var sent []string
+	for len(client.outgoing) > 0 {
+		sent = append(sent, <-client.outgoing)
+	}
+	want := []string{"3", "4", "NOTICE #chan :[1 more lines, send .more to continue]"}
+	if !reflect.DeepEqual(sent, want) {
+		t.Fatalf("sendMore sent %q, want %q", sent, want)
+	}
+}
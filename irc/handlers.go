@@ -3,107 +3,225 @@ package irc
 import (
 	"fmt"
 	"log"
-	"regexp"
 	"strings"
 )
 
-var handlers = []Handler{
-	{
-		condition: *regexp.MustCompile(`PING (\S+)`),
-		handler: func(s []string, ic *IrcClient) {
-			name := s[1]
-			ic.outgoing <- "PONG " + name
-		},
-	}, {
-		// Join channel after MOTD
-		condition: *regexp.MustCompile(":[a-z.0-9]+ 376 " + IRC_USER_REGEX + " :End of /MOTD command."),
-		handler: func(s []string, ic *IrcClient) {
-			// Join channel
-			ic.outgoing <- "JOIN " + ic.channel
-		},
-	}, {
-		condition: *regexp.MustCompile(":[a-z.0-9]+ 376 " + IRC_USER_REGEX + " :End of /MOTD command."),
-		handler: func(s []string, ic *IrcClient) {
-			if len(ic.password) != 0 {
-				log.Println("Sending password to NickServ")
-				ic.outgoing <- fmt.Sprintf("PRIVMSG NickServ :identify %s %s", ic.nick, ic.password)
-			} else {
-				log.Println("No password to identify nick")
-			}
-		},
-	}, {
-		// Handle NAMES result (provided on channel join as well)
-		condition: *regexp.MustCompile(`:[a-z.0-9]+ 353 \S+ = (\S+) :(.+)$`),
-		handler: func(s []string, ic *IrcClient) {
-			channel := s[1]
-			names := strings.Split(s[2], " ")
-			for _, name := range names {
-				if strings.HasPrefix(name, "@") {
-					// if someone is an operator, save them in the Operators map
-					cu, ok := ic.operators[channel]
-					if !ok {
-						cu = make(map[string]bool)
-						ic.operators[channel] = cu
-					}
-					cu[name[1:]] = true
-					log.Println("Found OP:", name, "in Channel", channel)
-				}
+type handlerfn func(msg Message, client *IrcClient)
+
+// Protocol handlers by command (or numeric)
+var handlers = map[string]handlerfn{
+	// Capability negotiation, see cap.go. A "*" before the list marks a multiline reply
+	"CAP": func(msg Message, ic *IrcClient) {
+		if len(msg.Params) < 3 {
+			return
+		}
+		more := len(msg.Params) > 3 && msg.Param(2) == "*"
+		ic.handleCap(strings.ToUpper(msg.Param(1)), more, msg.Trailing())
+	},
+	// The server is ready for our SASL credentials
+	"AUTHENTICATE": func(msg Message, ic *IrcClient) {
+		if msg.Param(0) == "+" {
+			ic.authenticate()
+		}
+	},
+	// SASL results: 903 success, 902 and 904 to 908 failures
+	"902": saslNumeric,
+	"903": saslNumeric,
+	"904": saslNumeric,
+	"905": saslNumeric,
+	"906": saslNumeric,
+	"907": saslNumeric,
+	"908": func(msg Message, ic *IrcClient) {
+		// Lists the mechanisms the server supports
+		ic.saslResult(msg.Command, msg.Param(1))
+	},
+	"PING": func(msg Message, ic *IrcClient) {
+		ic.sendPriority(NewMessage("PONG", msg.Params...).String())
+	},
+	// RPL_WELCOME, the first parameter is the nick we got
+	"001": func(msg Message, ic *IrcClient) {
+		ic.welcomed(msg.Param(0))
+	},
+	// RPL_ISUPPORT, we only care about MONITOR and NICKLEN
+	"005": func(msg Message, ic *IrcClient) {
+		// The first parameter is our nick, the last a human readable text
+		if len(msg.Params) > 2 {
+			ic.isupport(msg.Params[1 : len(msg.Params)-1])
+		}
+	},
+	// ERR_NICKNAMEINUSE, ERR_NICKCOLLISION and ERR_UNAVAILRESOURCE (nick delayed after a netsplit)
+	"433": nickUnavailable,
+	"436": nickUnavailable,
+	"437": nickUnavailable,
+	// ERR_ERRONEUSNICKNAME, the server does not accept the nick at all (invalid characters, too long)
+	"432": func(msg Message, ic *IrcClient) {
+		ic.nickRefused(msg.Param(1), msg.Trailing(), true)
+	},
+	"NICK": func(msg Message, ic *IrcClient) {
+		if msg.Nick != "" && len(msg.Params) > 0 {
+			ic.nickChanged(msg.Nick, msg.Param(0))
+		}
+	},
+	// RPL_MONOFFLINE, the monitored configured nick is free now
+	"731": func(msg Message, ic *IrcClient) {
+		for _, target := range strings.Split(msg.Trailing(), ",") {
+			nick, _, _ := strings.Cut(target, "!")
+			if strings.EqualFold(nick, ic.nick) {
+				ic.regainNick()
 			}
-		},
-	}, {
-		// Listen to MODE messages promoting/demoting operators
-		condition: *regexp.MustCompile(`:\S+ MODE (\S+) ([+-])o (` + IRC_USER_REGEX + `)`),
-		handler: func(s []string, ic *IrcClient) {
-			channel := s[1]
-			change := s[2]
-			user := s[3]
-			channelops, ok := ic.operators[channel]
-			if !ok {
-				log.Println("WARNING: During handling of MODE a new channel in the operator list was created. This should not happen.")
-				channelops = make(map[string]bool)
-				ic.operators[channel] = channelops
+		}
+	},
+	// Answer to our keepalive PING, see pingLoop
+	"PONG": func(msg Message, ic *IrcClient) {
+		ic.ponged(msg.Trailing())
+	},
+	// End of MOTD (or no MOTD at all): registration is done
+	"376": registered,
+	"422": registered,
+	// NAMES result (provided on channel join as well)
+	"353": func(msg Message, ic *IrcClient) {
+		if len(msg.Params) < 4 {
+			return
+		}
+		channel := strings.ToLower(msg.Param(2))
+		for _, name := range strings.Fields(msg.Trailing()) {
+			// With multi-prefix all prefixes of a nick are listed (e.g. "@+nick"), not just the highest
+			prefixes := name[:len(name)-len(strings.TrimLeft(name, "~&@%+"))]
+			if strings.Contains(prefixes, "@") {
+				// if someone is an operator, save them in the Operators map
+				ic.operators.set(channel, name[len(prefixes):], true)
+				log.Println("Found OP:", name, "in Channel", channel)
 			}
-			channelops[user] = (change == "+")
-		},
-	}, {
-		// Handle PRIVMSG
-		condition: *regexp.MustCompile(`:(` + IRC_USER_REGEX + `)!\S+ PRIVMSG (\S+) :(.+)$`),
-		handler: func(s []string, ic *IrcClient) {
-			user := s[1]
-			target := s[2]
-			message := s[3]
-			id, err := ic.storeMessage(user, s[2], message)
-			if err != nil {
-				log.Println("ERROR while trying to store IRC message:", err)
-				log.Println("Due to the Error above this message will not be handeled")
-        return
+		}
+	},
+	// MODE messages promoting/demoting operators
+	"MODE": func(msg Message, ic *IrcClient) {
+		channel := strings.ToLower(msg.Param(0))
+		if !strings.HasPrefix(channel, "#") {
+			return // User modes
+		}
+		for user, op := range operatorChanges(msg.Param(1), msg.Params[min(2, len(msg.Params)):]) {
+			ic.operators.set(channel, user, op)
+		}
+	},
+	// Our own JOIN tells how the server sees us, needed to know how long our messages may be
+	"JOIN": func(msg Message, ic *IrcClient) {
+		if ic.isOwnNick(msg.Nick) && msg.Host != "" {
+			ic.source.Store(msg.Source)
+		}
+	},
+	// RPL_WHOISACCOUNT, the account a nick is identified with
+	"330": func(msg Message, ic *IrcClient) {
+		if len(msg.Params) >= 3 {
+			ic.whoisAccount(msg.Param(1), msg.Param(2))
+		}
+	},
+	// RPL_ENDOFWHOIS, without a 330 before the nick is not identified
+	"318": func(msg Message, ic *IrcClient) {
+		ic.whoisAccount(msg.Param(1), "")
+	},
+	"PRIVMSG": func(msg Message, ic *IrcClient) {
+		user := msg.Nick
+		target := msg.Param(0)
+		message := msg.Trailing()
+		if user == "" || len(msg.Params) < 2 {
+			return
+		}
+		if strings.TrimSpace(message) == MORE_COMMAND {
+			// Pagination is ours, the app never sees it
+			destination := target
+			if !strings.HasPrefix(target, "#") {
+				destination = user
 			}
-			// Check if this is a channel message
-			if strings.HasPrefix(target, "#") {
-				channel := target
-				operator, ok := ic.operators[channel][user]
-				if !ok {
-					operator = false
+			go ic.sendMore(destination)
+			return
+		}
+		id, err := ic.storeMessage(user, target, message)
+		if err != nil {
+			log.Println("ERROR while trying to store IRC message:", err)
+			log.Println("Due to the Error above this message will not be handeled")
+			return
+		}
+		if ic.HasCap("account-tag") {
+			// The server tags messages of identified users with their account, untagged means not identified
+			ic.whois.remember(id, msg.Tags["account"])
+		}
+		// Check if this is a channel message
+		if strings.HasPrefix(target, "#") {
+			channel := strings.ToLower(target)
+			if ic.isJoined(channel) && !ic.isOwnNick(user) && ic.app_handler != nil {
+				log.Println("Handing off handling of Message:", user, ":", message)
+				var msg_type string
+				if ic.operators.is(channel, user) {
+					msg_type = "channel.op"
+				} else {
+					msg_type = "channel.user"
 				}
-				if channel == ic.channel && user != ic.nick && ic.app_handler != nil {
-					log.Println("Handing off handling of Message:", user, ":", message)
-					var msg_type string
-					if operator {
-						msg_type = "channel.op"
-					} else {
-						msg_type = "channel.user"
-					}
-					ic.app_handler(msg_type, message, id)
-				}
-			} else if target == ic.nick {
-				if ic.app_handler != nil {
-          log.Println("Handing off handling of direct message")
-          // TODO: maybe introduce privileged users which can do more via /query and adjust the type
-					ic.app_handler("direct.nopermissions", message, id)
+				// The permissions are decided in order, the app works on its own (it may e.g. wait for a WHOIS reply)
+				go ic.app_handler(msg_type, message, id)
+			}
+		} else if ic.isOwnNick(target) {
+			if ic.app_handler != nil {
+				log.Println("Handing off handling of direct message")
+				// Operators of the main channel are privileged in queries as well
+				msg_type := "direct.nopermissions"
+				if ic.operators.is(ic.channel, user) {
+					msg_type = "direct.op"
 				}
-			} else {
-				log.Println("Message with unexpected target. Did we change nick and did not realize? Targeted at:", target)
+				go ic.app_handler(msg_type, message, id)
 			}
-		},
+		} else {
+			log.Println("Message with unexpected target:", target)
+		}
 	},
 }
+
+func nickUnavailable(msg Message, ic *IrcClient) {
+	ic.nickRefused(msg.Param(1), msg.Trailing(), false)
+}
+
+func saslNumeric(msg Message, ic *IrcClient) {
+	ic.saslResult(msg.Command, msg.Trailing())
+}
+
+// Joins the channels and, without SASL, identifies with NickServ
+func registered(msg Message, ic *IrcClient) {
+	ic.sendPriority("JOIN " + ic.channel)
+	for _, channel := range ic.extra {
+		ic.sendPriority("JOIN " + channel)
+	}
+	if ic.needsNickServ() {
+		// Fallback if SASL is not configured, not offered or failed
+		log.Println("Sending password to NickServ")
+		ic.sendPriority(fmt.Sprintf("PRIVMSG NickServ :identify %s %s", ic.nick, ic.password))
+	} else if len(ic.password) == 0 {
+		log.Println("No password to identify nick")
+	}
+	ic.monitorNick()
+	ic.regainNick()
+}
+
+// Channel modes taking a parameter when set and when unset. "l" (limit) only takes one when set,
+// all others not listed take none
+const mode_parameters = "ovhaqbeIk"
+
+// Extracts the operator changes from a mode string like "+o-v+o" and its parameters
+func operatorChanges(modes string, params []string) map[string]bool {
+	changes := make(map[string]bool)
+	adding := true
+	for _, mode := range modes {
+		switch {
+		case mode == '+' || mode == '-':
+			adding = mode == '+'
+		case strings.ContainsRune(mode_parameters, mode) || mode == 'l' && adding:
+			if len(params) == 0 {
+				return changes
+			}
+			if mode == 'o' {
+				changes[params[0]] = adding
+			}
+			params = params[1:]
+		}
+	}
+	return changes
+}
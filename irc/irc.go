@@ -2,23 +2,38 @@ package irc
 
 import (
 	"LetsGoTroet/app"
-	"bytes"
+	"bufio"
 	"crypto/tls"
 	"database/sql"
 	"errors"
 	"fmt"
-	"io"
 	"log"
-	"math"
-	"regexp"
+	"net"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
+	"unicode/utf8"
 )
 
 const MSG_BUF_LEN = 10
-const IRC_USER_REGEX = `[a-zA-Z0-9-_\[\]\{\}\\\|` + "`" + `]{2,9}`
+
+// Number of received messages waiting for the dispatcher
+const EVENT_BUF_LEN = 100
 const IRC_MESSAGE_LENGTH_MAX = 512
+
+// Longest line accepted from the server: 8191 bytes of tags (IRCv3 message-tags) plus the message itself
+const MAX_LINE_LENGTH = 8191 + IRC_MESSAGE_LENGTH_MAX
+
+// First delay before reconnecting, see RECONNECT_DELAY_MAX
+const RECONNECT_DELAY = 10 * time.Second
+
+// How long Quit waits for the server to close the connection
+const QUIT_TIMEOUT = 5 * time.Second
+
+// How long to wait for a WHOIS to tell the account of a nick. Usually RPL_ENDOFWHOIS ends the wait earlier
+const WHOIS_TIMEOUT = 5 * time.Second
 const create_table = `
   CREATE TABLE IF NOT EXISTS messages_irc(
     id INTEGER NOT NULL PRIMARY KEY,
@@ -30,107 +45,400 @@ const create_table = `
 `
 
 type IrcClient struct {
-	connection  *tls.Conn
-	outgoing    chan string
+	address string
+	dialing dialOptions
+	// The current connection and its session, nil while disconnected
+	connection      net.Conn
+	session         *session
+	connectionMutex sync.Mutex
+	// Set and closed by Quit
+	quitting atomic.Bool
+	quit     chan struct{}
+	// Closed when the Eventloop returned
+	stopped  chan struct{}
+	outgoing chan string
+	flood    *floodControl
+	pages    *pager
+	// Our nick!user@host as seen by others, a string
+	source atomic.Value
+	// The configured nick, see nicks for the one in use
 	nick        string
+	nicks       *nickState
+	keepalive   *keepalive
 	channel     string
-	handlers    []Handler
+	extra       []string
+	handlers    map[string]handlerfn
 	password    string
-	operators   map[string]map[string]bool
+	operators   *operatorList
 	app_handler app.MessageHandler
 	db          *sql.DB
+	whois       *whoisLookup
+	caps        *capabilities
+	// SASL mechanism (empty: no SASL) and account, see SetSASL
+	saslMechanism string
+	saslAccount   string
+	certificate   *tls.Certificate
 }
 
-type handlerfn func(regex_condition []string, client *IrcClient)
+// Channel operators by channel (lowercase) and nick. Written by the protocol handlers, read by everyone
+type operatorList struct {
+	mutex    sync.Mutex
+	channels map[string]map[string]bool
+}
 
-type Handler struct {
-	condition regexp.Regexp
-	handler   handlerfn
+func (ops *operatorList) set(channel string, nick string, operator bool) {
+	ops.mutex.Lock()
+	defer ops.mutex.Unlock()
+	channel = strings.ToLower(channel)
+	if _, ok := ops.channels[channel]; !ok {
+		ops.channels[channel] = make(map[string]bool)
+	}
+	ops.channels[channel][nick] = operator
 }
 
-func (c *IrcClient) Eventloop() {
-	active := true
-	var leftover []byte
-	leftover = nil
+func (ops *operatorList) is(channel string, nick string) bool {
+	ops.mutex.Lock()
+	defer ops.mutex.Unlock()
+	return ops.channels[strings.ToLower(channel)][nick]
+}
 
+// Forgets everything, e.g. after a reconnect the channels are joined anew
+func (ops *operatorList) reset() {
+	ops.mutex.Lock()
+	defer ops.mutex.Unlock()
+	ops.channels = make(map[string]map[string]bool)
+}
+
+// Moves the operator status of a nick to its new nick in all channels
+func (ops *operatorList) rename(old string, new string) {
+	ops.mutex.Lock()
+	defer ops.mutex.Unlock()
+	for _, nicks := range ops.channels {
+		if op, found := nicks[old]; found {
+			delete(nicks, old)
+			nicks[new] = op
+		}
+	}
+}
+
+// Pending WHOIS requests for the services account of nicks
+type whoisLookup struct {
+	mutex   sync.Mutex
+	pending map[string][]chan string
+	// With account-tag the accounts of the latest received messages (empty: not identified), by message id
+	tagged map[string]string
+	order  []string
+}
+
+// How many accounts from account tags are kept
+const ACCOUNT_TAG_CACHE = 1000
+
+// Remembers the account the server tagged a message with
+func (w *whoisLookup) remember(messageid string, account string) {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	w.tagged[messageid] = account
+	w.order = append(w.order, messageid)
+	if len(w.order) > ACCOUNT_TAG_CACHE {
+		delete(w.tagged, w.order[0])
+		w.order = w.order[1:]
+	}
+}
+
+func (w *whoisLookup) taggedAccount(messageid string) (string, bool) {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	account, found := w.tagged[messageid]
+	return account, found
+}
+
+// Connects (and reconnects) to the server until Quit is called. Each connection has a reader (this goroutine),
+// a writer sending the outgoing queue as soon as something is queued, and a dispatcher handling the protocol events
+// one after another in the order they arrived (see dispatch). Handlers must not block, work for the app is handed
+// off to its own goroutines.
+func (c *IrcClient) Eventloop() {
 	log.Println("IRC Adapter Loop started")
-	timeoffset, _ := time.ParseDuration("1s")
-	for active {
-		// First catch a broken connection and reinitialize
-		if c.connection == nil {
+	defer close(c.stopped)
+	defer c.keepalive.setState(state_stopped)
+	for !c.quitting.Load() {
+		conn, err := c.dial()
+		if err != nil {
+			log.Println(err)
+			// Probably something horrible happened. Let's wait a bit, longer with every failure
+			c.waitReconnect()
+			continue
+		}
+		log.Println("IRC connection to", c.address, "established")
+		c.keepalive.setState(state_registering)
+		c.serve(conn)
+		log.Println("IRC connection closed")
+		if !c.quitting.Load() {
+			c.waitReconnect()
+		}
+	}
+}
+
+// Runs one connection until it breaks or is closed
+func (c *IrcClient) serve(conn net.Conn) {
+	// Whatever was queued for the old connection is of no use before registration
+	c.discardOutgoing()
+	c.operators.reset()
+	c.source.Store("")
+	c.resetNick()
+	s := newSession()
+	c.setConnection(conn, s)
+
+	events := make(chan Message, EVENT_BUF_LEN)
+	// Everything belonging to the connection ends before it is replaced, so nothing meant for it is sent on the next one
+	var running sync.WaitGroup
+	running.Add(4)
+	go func() {
+		defer running.Done()
+		c.dispatch(events)
+	}()
+	go func() {
+		defer running.Done()
+		c.writeLoop(conn, s)
+	}()
+	go func() {
+		defer running.Done()
+		c.regainLoop(s.done)
+	}()
+	go func() {
+		defer running.Done()
+		c.pingLoop(conn, s.done)
+	}()
+
+	c.startNegotiation()
+	c.sendPriority("NICK "+c.nick, "USER "+c.nick+" * * :LetsGoTroet Bot")
+
+	reader := bufio.NewReaderSize(conn, MAX_LINE_LENGTH)
+	for {
+		line, err := readLine(reader)
+		if err != nil {
+			if !c.quitting.Load() {
+				log.Println("Error on recieving IRC Messages:", err)
+			}
+			break
+		}
+		// log.Println(line) // Enable for very verbose Debug logging
+		if line == "" {
+			continue
+		}
+		msg, err := ParseMessage(line)
+		if err != nil {
+			log.Println("Invalid IRC message:", err)
+			continue
+		}
+		select {
+		case events <- msg:
+		case <-s.done:
+			// The connection is gone, reading ends with the next line at the latest
+		}
+	}
+	s.end()
+	conn.Close()
+	close(events)
+	running.Wait()
+	c.setConnection(nil, nil)
+}
 
-			config := &tls.Config{}
-			irccon, err := tls.Dial("tcp", "irc.hackint.org:6697", config)
+// Reads one line without the line ending. Lines longer than MAX_LINE_LENGTH are skipped
+func readLine(reader *bufio.Reader) (string, error) {
+	for {
+		line, err := reader.ReadSlice('\n')
+		if errors.Is(err, bufio.ErrBufferFull) {
+			log.Println("Skipping IRC line longer than", MAX_LINE_LENGTH, "bytes")
+			for errors.Is(err, bufio.ErrBufferFull) {
+				_, err = reader.ReadSlice('\n')
+			}
 			if err != nil {
-				log.Println(err)
-				// Probably something horrible happened. Let's wait a bit
-				duration, _ := time.ParseDuration("10s")
-				time.Sleep(duration)
-				continue
-			} else {
-				log.Println("IRC connection established")
+				return "", err
 			}
+			continue
+		}
+		if err != nil {
+			return "", err
+		}
+		return strings.TrimRight(string(line), "\r\n"), nil
+	}
+}
+
+// The protocol lines of one connection. Lines queued for a connection never end up on the next one
+type session struct {
+	// Protocol replies like PONG, sent before anything in outgoing
+	priority chan string
+	// Closed when the connection is gone (see end)
+	done chan struct{}
+	once sync.Once
+}
+
+func newSession() *session {
+	return &session{
+		priority: make(chan string, MSG_BUF_LEN),
+		done:     make(chan struct{}),
+	}
+}
 
-			outbound := make(chan string, MSG_BUF_LEN)
-			outbound <- "NICK " + c.nick
-			outbound <- "USER " + c.nick + " * * :LetsGoTroet Bot"
+// Marks the connection as gone. Called by the writer when a write fails and by serve when reading ends
+func (s *session) end() {
+	s.once.Do(func() { close(s.done) })
+}
 
-			c.connection = irccon
-			c.outgoing = outbound
+// Queues the lines in order. Returns false without waiting any longer once the connection is gone
+func (s *session) send(lines ...string) bool {
+	for _, line := range lines {
+		select {
+		case <-s.done:
+			return false
+		default:
 		}
+		select {
+		case s.priority <- line:
+		case <-s.done:
+			return false
+		}
+	}
+	return true
+}
 
-		c.connection.SetReadDeadline(time.Now().Add(timeoffset))
-		// this could, in theory, be exploited by a malicuous IRC server
-		// but this depends on the connection being able to deliver several gigabytes in one Read()
-		buffer, err := io.ReadAll(c.connection)
-		if len(buffer) == 0 {
-			if !strings.Contains(err.Error(), "i/o timeout") {
-				// we assume that when we did not get anything this is due to no messages being sent to us within the timeout
-				// if the error message is NOT a timeout this should be handeled somehow
-				log.Println("Unusual Error on recieving IRC Messages:", err)
-				log.Println("Turning off IRC client.")
-				c.connection = nil
-				// duration, _ :=time.ParseDuration("120s") // In this case we wait 120 seconds so the IRC server can timeout our client
-				// time.Sleep(duration)
-				continue // Don't do anything else, our client is broken
-			}
+// Queues protocol lines for the current connection, they are dropped while disconnected.
+// Must not be called with a mutex held, the queue might be full.
+func (c *IrcClient) sendPriority(lines ...string) {
+	c.connectionMutex.Lock()
+	s := c.session
+	c.connectionMutex.Unlock()
+	if s != nil {
+		s.send(lines...)
+	}
+}
 
-			continue_sending := true
-			for continue_sending {
-				select {
-				case next_msg := <-c.outgoing:
-					// log.Println("Sending:", next_msg)
-					_, err := c.connection.Write(append([]byte(next_msg), []byte("\r\n")...))
-					if err != nil {
-						log.Println(err)
-					}
-				default:
-					continue_sending = false
-				}
-			}
-		} else {
-			messages := buffer
-			if leftover != nil {
-				messages = append(leftover, messages...)
-				leftover = nil
+// Sends queued messages until the session is done. A failed write ends the session and closes the connection,
+// which ends the reader as well.
+// Lines from the priority queue (protocol replies like PONG) go first and never wait for the flood control.
+func (c *IrcClient) writeLoop(conn net.Conn, s *session) {
+	done := s.done
+	write := func(line string) bool {
+		// log.Println("Sending:", line)
+		if _, err := conn.Write([]byte(limitLine(line) + "\r\n")); err != nil {
+			log.Println("Error sending IRC message:", err)
+			// Nobody sends the queued lines any more, so nobody should wait to queue more
+			s.end()
+			conn.Close()
+			return false
+		}
+		return true
+	}
+	for {
+		select {
+		case line := <-s.priority:
+			c.flood.spend()
+			if !write(line) {
+				return
 			}
-			lines := bytes.Split(messages, []byte("\r\n"))
-			if messages[len(messages)-1] != byte('\n') || messages[len(messages)-2] != byte('\r') {
-				leftover = lines[len(lines)-1] // store last element as leftover (since it's not terminated by /r/n and might be followed up in next messages)
-				lines = lines[:len(lines)-1]   // removes last element
+			continue
+		default:
+		}
+		select {
+		case <-done:
+			return
+		case line := <-s.priority:
+			c.flood.spend()
+			if !write(line) {
+				return
 			}
-			for _, line := range lines {
-				// log.Println(string(line)) // Enable for very verbose Debug logging
-				strline := string(line)
-				for _, handler := range c.handlers {
-					if handler.condition.MatchString(strline) {
-						go handler.handler(handler.condition.FindStringSubmatch(strline), c)
+		case line := <-c.outgoing:
+			for wait := c.flood.take(); wait > 0; wait = c.flood.take() {
+				select {
+				case <-done:
+					return
+				case urgent := <-s.priority:
+					c.flood.spend()
+					if !write(urgent) {
+						return
 					}
+				case <-time.After(wait):
 				}
 			}
+			if !write(line) {
+				return
+			}
 		}
 	}
-	c.connection.Close()
+}
+
+// Cuts lines the server would refuse (512 bytes including CRLF) without splitting a character
+func limitLine(line string) string {
+	max := IRC_MESSAGE_LENGTH_MAX - 2
+	if len(line) <= max {
+		return line
+	}
+	log.Println("Cutting IRC line longer than", max, "bytes:", line)
+	for max > 0 && !utf8.RuneStart(line[max]) {
+		max--
+	}
+	return line[:max]
+}
+
+// Runs the protocol handlers in order until the connection is gone and events is closed
+func (c *IrcClient) dispatch(events chan Message) {
+	for msg := range events {
+		if handler, found := c.handlers[msg.Command]; found {
+			handler(msg, c)
+		}
+	}
+}
+
+func (c *IrcClient) discardOutgoing() {
+	for {
+		select {
+		case next_msg := <-c.outgoing:
+			log.Println("Discarding message queued before reconnect:", next_msg)
+		default:
+			return
+		}
+	}
+}
+
+func (c *IrcClient) setConnection(conn net.Conn, s *session) {
+	c.connectionMutex.Lock()
+	defer c.connectionMutex.Unlock()
+	c.connection = conn
+	c.session = s
+}
+
+// Leaves IRC: sends QUIT and waits (at most QUIT_TIMEOUT) for the server to close the connection.
+// The Eventloop returns afterwards instead of reconnecting.
+func (c *IrcClient) Quit(reason string) {
+	if c.quitting.Swap(true) {
+		return
+	}
+	close(c.quit)
+	c.connectionMutex.Lock()
+	s := c.session
+	c.connectionMutex.Unlock()
+	if s != nil {
+		select {
+		case s.priority <- "QUIT :" + reason:
+		case <-s.done:
+		case <-time.After(QUIT_TIMEOUT):
+		}
+	}
+	select {
+	case <-c.stopped:
+		return
+	case <-time.After(QUIT_TIMEOUT):
+	}
+	c.connectionMutex.Lock()
+	if c.connection != nil {
+		c.connection.Close()
+	}
+	c.connectionMutex.Unlock()
+	select {
+	case <-c.stopped:
+	case <-time.After(QUIT_TIMEOUT):
+		log.Println("IRC client did not stop")
+	}
 }
 
 // Used to set the password given to NickServ to Identify upon being requested to do so
@@ -138,54 +446,75 @@ func (c *IrcClient) SetPassword(password string) {
 	c.password = password
 }
 
+// Joins an additional channel (e.g. for ops) after connecting. Messages in additional channels are handed to the app like
+// messages in the main channel, Origin() tells them apart. Needs to be called before the Eventloop is started.
+func (c *IrcClient) AddChannel(channel string) {
+	if !strings.HasPrefix(channel, "#") {
+		channel = "#" + channel
+	}
+	c.extra = append(c.extra, strings.ToLower(channel))
+}
+
+// Checks if the channel is the main channel or one of the additional channels
+func (c *IrcClient) isJoined(channel string) bool {
+	channel = strings.ToLower(channel)
+	if channel == c.channel {
+		return true
+	}
+	for _, extra := range c.extra {
+		if channel == extra {
+			return true
+		}
+	}
+	return false
+}
+
 // The IrcClient's Send function converts a message to a new PRIVMSG command
 // to the channel configured during creation of the IrcClient (see irc.New).
 // To do the actual sending the interal irc.send is used (due to that allowing different targets but straying away from the adapter specification)
-func (c IrcClient) Send(content string) (string, error) {
+func (c *IrcClient) Send(content string) (string, error) {
 	return c.send(content, c.channel)
 }
 
 // Since reply might reply to private messages the sending should support also sending to different destinations.
 // This is the internal send which can specify the destination.
 // This command is not sent directly but appended to an outgoing messages queue handeled in IrcClient.Eventloop().
+// Long outputs are paginated (see SetPageLength).
 // Consequently it will always return nil, since we cannot track errors here.
-func (c IrcClient) send(content string, destination string) (string, error) {
-  command := "PRIVMSG"
-  if strings.HasPrefix(destination, "#") {
-    // Channels only get "NOTICE"
-    command = "NOTICE"
-  }
-	lines := strings.Split(content, "\n")
-  for _, line := range lines {
-    target :=  command + " " + destination + " :"
-		command := target + line
-    if len(command) > IRC_MESSAGE_LENGTH_MAX {
-      maxline := IRC_MESSAGE_LENGTH_MAX - len(target)
-      nummessages := math.Ceil(float64(len(line)) / float64(maxline))
-      // TODO: This line cutting can cut through a rune (utf-8 character)
-      // You'd need to convert to []rune for splitting 
-      // while making sure that the line length (in bytes) does not exceed IRC_MESSAGE_LENGTH_MAX
-      for i := 0; i < int(nummessages); i++ {
-        from := i * maxline
-        to := (i+1) * maxline
-        if to > len(line) {
-          to = len(line)
-        }
-        c.send(line[from:to], destination)
-      } 
-    }
-		// log.Println(command)
-		c.outgoing <- command
-	}
-	c.storeMessage(c.nick, destination, content)
+func (c *IrcClient) send(content string, destination string) (string, error) {
+	lines, left := c.paginate(destination, c.split(content, destination))
+	c.queue(destination, lines, left)
+	c.storeMessage(c.Nick(), destination, content)
 	return content, nil
 }
 
+// Converts the content to the lines to send, one or more per line of content. The server prepends our source
+// (:nick!user@host) when relaying, which counts against the line length as well.
+func (c *IrcClient) split(content string, destination string) []string {
+	target := c.command(destination) + " " + destination + " :"
+	max := IRC_MESSAGE_LENGTH_MAX - len("\r\n") - len(":"+c.ownSource()+" ") - len(target)
+	var commands []string
+	for _, line := range strings.Split(content, "\n") {
+		for _, part := range splitLine(line, max) {
+			commands = append(commands, target+part)
+		}
+	}
+	return commands
+}
+
+// Our source as the server relays it. Until we learn it from our own JOIN the longest possible one is assumed
+func (c *IrcClient) ownSource() string {
+	if source, ok := c.source.Load().(string); ok && source != "" {
+		return source
+	}
+	return c.Nick() + "!" + strings.Repeat("x", max_user_length) + "@" + strings.Repeat("x", max_host_length)
+}
+
 // Replies to a message given by messageid
 // If the given content contains a " %s " it will be treated as a format string and the person to whom is replied is sprintf'd into there
 // Otherwise the reply message with start with the name of the originator
 // MessageIDs not found in the Database will return an error containing the id as text
-func (c IrcClient) Reply(messageid string, content string) (string, error) {
+func (c *IrcClient) Reply(messageid string, content string) (string, error) {
 	// get message/user from DB
 	// if not found return a not-found error
 	// else return c.Send(user + ": " + content)
@@ -228,12 +557,121 @@ func (c IrcClient) Reply(messageid string, content string) (string, error) {
 	return c.send(toSend, target)
 }
 
+// Returns the nick of the sender of the message given by messageid
+func (c *IrcClient) Author(messageid string) (string, error) {
+	id, err := strconv.Atoi(messageid)
+	if err != nil {
+		return "", err
+	}
+	row := c.db.QueryRow("SELECT user FROM messages_irc WHERE id=?", id)
+	var sender string
+	if err := row.Scan(&sender); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return "", fmt.Errorf("Message not found in IRC Message database: %s", messageid)
+		}
+		return "", err
+	}
+	return sender, nil
+}
+
+// Sends a message to a different target than the main channel, i.e. a nick (as query) or another channel
+func (c *IrcClient) SendTo(target string, content string) (string, error) {
+	return c.send(content, target)
+}
+
+// Returns where the message given by messageid was written: the channel or, for direct messages, the nick of the sender
+func (c *IrcClient) Origin(messageid string) (string, error) {
+	id, err := strconv.Atoi(messageid)
+	if err != nil {
+		return "", err
+	}
+	row := c.db.QueryRow("SELECT user, channel FROM messages_irc WHERE id=?", id)
+	var sender string
+	var channel string
+	if err := row.Scan(&sender, &channel); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return "", fmt.Errorf("Message not found in IRC Message database: %s", messageid)
+		}
+		return "", err
+	}
+	if strings.HasPrefix(channel, "#") {
+		return strings.ToLower(channel), nil
+	}
+	return sender, nil
+}
+
+// Returns the services (NickServ) account the sender of the message is identified with, empty if not identified.
+// Messages tagged by the server (account-tag) tell right away, otherwise a WHOIS asks.
+func (c *IrcClient) Account(messageid string) (string, error) {
+	if account, found := c.whois.taggedAccount(messageid); found {
+		return account, nil
+	}
+	nick, err := c.Author(messageid)
+	if err != nil {
+		return "", err
+	}
+	result := make(chan string, 1)
+	c.whois.mutex.Lock()
+	key := strings.ToLower(nick)
+	c.whois.pending[key] = append(c.whois.pending[key], result)
+	c.whois.mutex.Unlock()
+	c.outgoing <- "WHOIS " + nick
+
+	select {
+	case account := <-result:
+		return account, nil
+	case <-time.After(WHOIS_TIMEOUT):
+		c.whois.mutex.Lock()
+		defer c.whois.mutex.Unlock()
+		waiting := c.whois.pending[key]
+		for i, ch := range waiting {
+			if ch == result {
+				c.whois.pending[key] = append(waiting[:i], waiting[i+1:]...)
+				break
+			}
+		}
+		return "", nil
+	}
+}
+
+// Hands the account from a WHOIS reply to everybody waiting for it. The end of the WHOIS hands an empty account
+// to those still waiting, the 330 with the account comes before it
+func (c *IrcClient) whoisAccount(nick string, account string) {
+	c.whois.mutex.Lock()
+	defer c.whois.mutex.Unlock()
+	key := strings.ToLower(nick)
+	for _, ch := range c.whois.pending[key] {
+		ch <- account
+	}
+	delete(c.whois.pending, key)
+}
+
+// Describes the connection state
+func (c *IrcClient) Status() string {
+	c.connectionMutex.Lock()
+	connected := c.connection != nil
+	c.connectionMutex.Unlock()
+	if !connected {
+		return "IRC: not connected, " + c.keepalive.describe()
+	}
+	nick := c.Nick()
+	status := fmt.Sprintf("IRC: connected as %s in %s", nick, strings.Join(append([]string{c.channel}, c.extra...), ", "))
+	if !strings.EqualFold(nick, c.nick) {
+		status += fmt.Sprintf(" (%s is taken)", c.nick)
+	}
+	status += ", " + c.keepalive.describe()
+	if caps := c.Capabilities(); len(caps) > 0 {
+		status += ", capabilities: " + strings.Join(caps, " ")
+	}
+	return status
+}
+
 func (c *IrcClient) RegisterMessageHandler(handler app.MessageHandler) {
 	log.Println("IRC -> RegisterMessageHandler")
 	c.app_handler = handler
 }
 
-func (c IrcClient) storeMessage(source string, target string, message string) (string, error) {
+func (c *IrcClient) storeMessage(source string, target string, message string) (string, error) {
 	var id int64
 	res, err := c.db.Exec("INSERT INTO messages_irc VALUES(NULL,?,?,?,?);", time.Now(), target, source, message)
 	if err != nil {
@@ -263,14 +701,27 @@ func New(adress string, username string, channel string, db *sql.DB) (*IrcClient
 	channel = strings.ToLower(channel)
 
 	return &IrcClient{
+		address:     adress,
 		connection:  nil,
-		outgoing:    nil,
+		outgoing:    make(chan string, MSG_BUF_LEN),
+		flood:       newFloodControl(FLOOD_BURST, FLOOD_INTERVAL),
+		pages:       &pager{lines: PAGE_LINES, pending: make(map[string][]string)},
+		quit:        make(chan struct{}),
+		stopped:     make(chan struct{}),
 		nick:        username,
+		nicks:       &nickState{current: username},
+		keepalive:   newKeepalive(PING_INTERVAL, PING_TIMEOUT),
 		channel:     channel,
+		extra:       nil,
 		password:    "",
 		handlers:    handlers,
-		operators:   make(map[string]map[string]bool),
+		operators:   &operatorList{channels: make(map[string]map[string]bool)},
 		db:          db,
 		app_handler: nil,
+		whois: &whoisLookup{
+			pending: make(map[string][]chan string),
+			tagged:  make(map[string]string),
+		},
+		caps: newCapabilities(),
 	}, nil
 }
@@ -0,0 +1,231 @@
+package irc
+
+import (
+	"bufio"
+	"database/sql"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	_ "github.com/mattn/go-sqlite3"
+)
+
+// A client connected to a fake server via net.Pipe. Everything the client sends is collected in sent.
+type testServer struct {
+	client *IrcClient
+	conn   net.Conn
+	sent   chan string
+	served chan struct{}
+}
+
+func newTestClient(t *testing.T) *IrcClient {
+	t.Helper()
+	db, err := sql.Open("sqlite3", ":memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Every connection would get its own in-memory database
+	db.SetMaxOpenConns(1)
+	t.Cleanup(func() { db.Close() })
+	client, err := New("irc.example.org", "bot", "#chan", db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return client
+}
+
+func startTestServer(t *testing.T, client *IrcClient) *testServer {
+	t.Helper()
+	server, conn := net.Pipe()
+	s := &testServer{client: client, conn: server, sent: make(chan string, 1000), served: make(chan struct{})}
+	go func() {
+		client.serve(conn)
+		close(s.served)
+	}()
+	go func() {
+		reader := bufio.NewReader(server)
+		for {
+			line, err := reader.ReadString('\n')
+			if err != nil {
+				return
+			}
+			s.sent <- strings.TrimRight(line, "\r\n")
+		}
+	}()
+	t.Cleanup(s.close)
+	return s
+}
+
+func (s *testServer) write(t *testing.T, line string) {
+	t.Helper()
+	if _, err := s.conn.Write([]byte(line + "\r\n")); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// Waits for a line sent by the client starting with prefix, skipping others
+func (s *testServer) expect(t *testing.T, prefix string) string {
+	t.Helper()
+	timeout := time.After(2 * time.Second)
+	for {
+		select {
+		case line := <-s.sent:
+			if strings.HasPrefix(line, prefix) {
+				return line
+			}
+		case <-timeout:
+			t.Fatalf("client did not send %q", prefix)
+		}
+	}
+}
+
+func (s *testServer) close() {
+	s.conn.Close()
+	<-s.served
+}
+
+// Lines are handled one after another in the order they arrived, while the app and status queries read
+// the shared state concurrently. Run with -race.
+func TestDispatchOrder(t *testing.T) {
+	client := newTestClient(t)
+	var mutex sync.Mutex
+	var handled []string
+	recording := make(map[string]handlerfn)
+	for command, handler := range handlers {
+		handler := handler
+		recording[command] = func(msg Message, ic *IrcClient) {
+			handler(msg, ic)
+			if msg.Command == "MODE" || msg.Command == "353" || msg.Command == "PRIVMSG" {
+				mutex.Lock()
+				handled = append(handled, msg.String())
+				mutex.Unlock()
+			}
+		}
+	}
+	client.handlers = recording
+	relayed := make(chan string, 1000)
+	client.RegisterMessageHandler(func(msgtype string, message string, messageID string) {
+		client.operators.is("#chan", "user0")
+		relayed <- message
+	})
+	server := startTestServer(t, client)
+
+	const rounds = 200
+	var lines []string
+	for i := 0; i < rounds; i++ {
+		user := fmt.Sprintf("user%d", i%5)
+		lines = append(lines,
+			fmt.Sprintf(":irc.example.org 353 bot = #chan :@%s +other%d", user, i),
+			fmt.Sprintf(":op!op@host MODE #chan -o %s", user),
+			fmt.Sprintf(":%s!%s@host PRIVMSG #chan :message %d", user, user, i),
+		)
+	}
+
+	done := make(chan struct{})
+	var readers sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		readers.Add(1)
+		go func(i int) {
+			defer readers.Done()
+			for {
+				select {
+				case <-done:
+					return
+				default:
+				}
+				client.operators.is("#chan", fmt.Sprintf("user%d", i))
+				client.Status()
+				client.Nick()
+				client.isJoined("#chan")
+			}
+		}(i)
+	}
+	for _, line := range lines {
+		server.write(t, line)
+	}
+	for i := 0; i < rounds; i++ {
+		select {
+		case <-relayed:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("only %d of %d messages relayed", i, rounds)
+		}
+	}
+	close(done)
+	readers.Wait()
+
+	mutex.Lock()
+	defer mutex.Unlock()
+	if len(handled) != len(lines) {
+		t.Fatalf("handled %d lines, want %d", len(handled), len(lines))
+	}
+	for i, line := range lines {
+		if handled[i] != line {
+			t.Fatalf("line %d handled as %q, want %q", i, handled[i], line)
+		}
+	}
+	// Every round ends with the MODE taking the operator status away again
+	for i := 0; i < 5; i++ {
+		if user := fmt.Sprintf("user%d", i); client.operators.is("#chan", user) {
+			t.Errorf("%s is still operator", user)
+		}
+	}
+}
+
+// Once the connection is gone nobody waits to queue protocol lines, even if the queue is full
+func TestSessionEnd(t *testing.T) {
+	s := newSession()
+	for i := 0; i < MSG_BUF_LEN; i++ {
+		if !s.send("PONG") {
+			t.Fatalf("line %d refused while connected", i)
+		}
+	}
+	sent := make(chan bool)
+	go func() { sent <- s.send("PONG") }()
+	s.end()
+	s.end()
+	select {
+	case ok := <-sent:
+		if ok {
+			t.Error("full queue accepted a line after the session ended")
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("send still waits after the session ended")
+	}
+	if s.send("PONG") {
+		t.Error("line accepted after the session ended")
+	}
+}
+
+// A server that stops reading fills the protocol queue, closing the connection must end serve anyway
+func TestServeEndsWithFullQueue(t *testing.T) {
+	client := newTestClient(t)
+	server, conn := net.Pipe()
+	served := make(chan struct{})
+	go func() {
+		client.serve(conn)
+		close(served)
+	}()
+	go func() {
+		// Every PING is answered with a PONG nobody reads
+		for i := 0; i < MSG_BUF_LEN+EVENT_BUF_LEN+10; i++ {
+			if _, err := server.Write([]byte(fmt.Sprintf("PING :%d\r\n", i))); err != nil {
+				return
+			}
+		}
+	}()
+	time.Sleep(100 * time.Millisecond)
+	server.Close()
+	select {
+	case <-served:
+	case <-time.After(5 * time.Second):
+		t.Fatal("serve did not return after the connection was closed")
+	}
+	client.connectionMutex.Lock()
+	defer client.connectionMutex.Unlock()
+	if client.session != nil {
+		t.Error("session still set after serve returned")
+	}
+}
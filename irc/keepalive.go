@@ -0,0 +1,164 @@
+package irc
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Default keepalive: a PING after this long, the connection counts as dead without PONG within the timeout
+const PING_INTERVAL = 30 * time.Second
+const PING_TIMEOUT = 60 * time.Second
+
+// Reconnects wait RECONNECT_DELAY, doubled after every failed attempt up to RECONNECT_DELAY_MAX
+const RECONNECT_DELAY_MAX = 5 * time.Minute
+
+// Connection states shown by Status
+const (
+	state_connecting   = "connecting"
+	state_registering  = "registering"
+	state_connected    = "connected"
+	state_reconnecting = "reconnecting"
+	state_stopped      = "stopped"
+)
+
+// Connection health: outstanding PING, the measured lag and the reconnect backoff
+type keepalive struct {
+	mutex    sync.Mutex
+	interval time.Duration
+	timeout  time.Duration
+	state    string
+	since    time.Time
+	// Token of the PING waiting for its PONG, pong is signalled once it arrives
+	token string
+	sent  time.Time
+	pong  chan struct{}
+	lag   time.Duration
+	// Failed connection attempts since the last successful registration
+	failures  int
+	reconnect time.Time
+}
+
+func newKeepalive(interval time.Duration, timeout time.Duration) *keepalive {
+	return &keepalive{interval: interval, timeout: timeout, state: state_connecting, since: time.Now()}
+}
+
+// Sets how often to PING the server and how long to wait for the PONG before reconnecting.
+// Needs to be called before the Eventloop is started.
+func (c *IrcClient) SetKeepalive(interval time.Duration, timeout time.Duration) {
+	c.keepalive.interval = interval
+	c.keepalive.timeout = timeout
+}
+
+func (k *keepalive) setState(state string) {
+	k.mutex.Lock()
+	defer k.mutex.Unlock()
+	k.state = state
+	k.since = time.Now()
+	if state == state_connected {
+		k.failures = 0
+	}
+}
+
+// How long to wait before the next connection attempt. Every call counts as a failure, a successful
+// registration resets the backoff
+func (k *keepalive) backoff() time.Duration {
+	k.mutex.Lock()
+	defer k.mutex.Unlock()
+	delay := RECONNECT_DELAY
+	for i := 0; i < k.failures && delay < RECONNECT_DELAY_MAX; i++ {
+		delay *= 2
+	}
+	delay = min(delay, RECONNECT_DELAY_MAX)
+	k.failures++
+	k.state = state_reconnecting
+	k.since = time.Now()
+	k.reconnect = k.since.Add(delay)
+	return delay
+}
+
+// Waits before reconnecting, returns early on Quit
+func (c *IrcClient) waitReconnect() {
+	delay := c.keepalive.backoff()
+	log.Println("Reconnecting to IRC in", delay)
+	select {
+	case <-time.After(delay):
+	case <-c.quit:
+	}
+	c.keepalive.setState(state_connecting)
+}
+
+// PINGs the server every interval until done is closed. Without PONG within the timeout the connection is closed,
+// which makes the Eventloop reconnect.
+func (c *IrcClient) pingLoop(conn net.Conn, done chan struct{}) {
+	k := c.keepalive
+	if k.interval <= 0 {
+		return
+	}
+	pong := make(chan struct{}, 1)
+	for {
+		select {
+		case <-done:
+			return
+		case <-time.After(k.interval):
+		}
+		token := "LetsGoTroet-" + strconv.FormatInt(time.Now().UnixNano(), 10)
+		k.mutex.Lock()
+		k.token = token
+		k.sent = time.Now()
+		k.pong = pong
+		k.mutex.Unlock()
+		c.sendPriority("PING :" + token)
+		select {
+		case <-done:
+			return
+		case <-pong:
+		case <-time.After(k.timeout):
+			log.Println("No PONG from the IRC server for", k.timeout, "- reconnecting")
+			conn.Close()
+			return
+		}
+	}
+}
+
+// A PONG arrived, if it answers our PING the lag is measured
+func (c *IrcClient) ponged(token string) {
+	k := c.keepalive
+	k.mutex.Lock()
+	defer k.mutex.Unlock()
+	if token != k.token || k.pong == nil {
+		return
+	}
+	k.lag = time.Since(k.sent)
+	k.token = ""
+	select {
+	case k.pong <- struct{}{}:
+	default:
+	}
+}
+
+// Describes the connection state and, while connected, the lag of the last PING
+func (k *keepalive) describe() string {
+	k.mutex.Lock()
+	defer k.mutex.Unlock()
+	since := time.Since(k.since).Round(time.Second)
+	switch k.state {
+	case state_connected:
+		description := fmt.Sprintf("up for %s", since)
+		if k.token != "" && time.Since(k.sent) > k.lag {
+			// An outstanding PING tells more than the last lag
+			return description + fmt.Sprintf(", lag %s (waiting for PONG)", time.Since(k.sent).Round(time.Millisecond))
+		}
+		if k.lag > 0 {
+			description += fmt.Sprintf(", lag %s", k.lag.Round(time.Millisecond))
+		}
+		return description
+	case state_reconnecting:
+		return fmt.Sprintf("reconnecting in %s (attempt %d)", max(0, time.Until(k.reconnect)).Round(time.Second), k.failures)
+	default:
+		return fmt.Sprintf("%s for %s", k.state, since)
+	}
+}
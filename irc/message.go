@@ -0,0 +1,171 @@
+package irc
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// A parsed IRC message (RFC 1459 with IRCv3 message tags):
+//
+//	@tag=value;other :nick!user@host COMMAND param param :trailing param
+//
+// Source is the complete prefix, Nick, User and Host its parts (Nick holds the server name for server messages).
+// The trailing parameter is the last entry of Params like any other.
+type Message struct {
+	Tags    map[string]string
+	Source  string
+	Nick    string
+	User    string
+	Host    string
+	Command string
+	Params  []string
+}
+
+// Parses a line as received from the server, without the trailing CRLF
+func ParseMessage(line string) (Message, error) {
+	var msg Message
+	line = strings.TrimRight(line, "\r\n")
+	if strings.HasPrefix(line, "@") {
+		tags, rest, found := strings.Cut(line[1:], " ")
+		if !found {
+			return msg, fmt.Errorf("Message consists of tags only: %s", line)
+		}
+		msg.Tags = parseTags(tags)
+		line = strings.TrimLeft(rest, " ")
+	}
+	if strings.HasPrefix(line, ":") {
+		source, rest, found := strings.Cut(line[1:], " ")
+		if !found {
+			return msg, fmt.Errorf("Message without command: %s", line)
+		}
+		msg.Source = source
+		msg.Nick, msg.User, msg.Host = splitSource(source)
+		line = strings.TrimLeft(rest, " ")
+	}
+	command, rest, _ := strings.Cut(line, " ")
+	if command == "" {
+		return msg, fmt.Errorf("Message without command: %s", line)
+	}
+	msg.Command = strings.ToUpper(command)
+	for rest != "" {
+		rest = strings.TrimLeft(rest, " ")
+		if rest == "" {
+			break
+		}
+		if strings.HasPrefix(rest, ":") {
+			msg.Params = append(msg.Params, rest[1:])
+			break
+		}
+		var param string
+		param, rest, _ = strings.Cut(rest, " ")
+		msg.Params = append(msg.Params, param)
+	}
+	return msg, nil
+}
+
+// Splits nick!user@host, parts not present stay empty
+func splitSource(source string) (string, string, string) {
+	nick, host, _ := strings.Cut(source, "@")
+	nick, user, _ := strings.Cut(nick, "!")
+	return nick, user, host
+}
+
+func parseTags(raw string) map[string]string {
+	tags := make(map[string]string)
+	for _, tag := range strings.Split(raw, ";") {
+		if tag == "" {
+			continue
+		}
+		key, value, _ := strings.Cut(tag, "=")
+		tags[key] = unescapeTagValue(value)
+	}
+	return tags
+}
+
+// Tag values escape ";", space, backslash, CR and LF. A trailing lone backslash is dropped, unknown escapes lose the backslash
+func unescapeTagValue(value string) string {
+	var unescaped strings.Builder
+	for i := 0; i < len(value); i++ {
+		if value[i] != '\\' {
+			unescaped.WriteByte(value[i])
+			continue
+		}
+		i++
+		if i == len(value) {
+			break
+		}
+		switch value[i] {
+		case ':':
+			unescaped.WriteByte(';')
+		case 's':
+			unescaped.WriteByte(' ')
+		case 'r':
+			unescaped.WriteByte('\r')
+		case 'n':
+			unescaped.WriteByte('\n')
+		default:
+			unescaped.WriteByte(value[i])
+		}
+	}
+	return unescaped.String()
+}
+
+var tag_escaper = strings.NewReplacer(`\`, `\\`, ";", `\:`, " ", `\s`, "\r", `\r`, "\n", `\n`)
+
+// Serializes the message to a line to send, without CRLF. Tags are sorted to keep the output stable.
+// The last parameter is sent as trailing parameter if needed (empty, containing spaces or starting with ":").
+func (msg Message) String() string {
+	var line strings.Builder
+	if len(msg.Tags) > 0 {
+		keys := make([]string, 0, len(msg.Tags))
+		for key := range msg.Tags {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		line.WriteByte('@')
+		for i, key := range keys {
+			if i > 0 {
+				line.WriteByte(';')
+			}
+			line.WriteString(key)
+			if value := msg.Tags[key]; value != "" {
+				line.WriteByte('=')
+				line.WriteString(tag_escaper.Replace(value))
+			}
+		}
+		line.WriteByte(' ')
+	}
+	if msg.Source != "" {
+		line.WriteByte(':')
+		line.WriteString(msg.Source)
+		line.WriteByte(' ')
+	}
+	line.WriteString(msg.Command)
+	for i, param := range msg.Params {
+		line.WriteByte(' ')
+		if i == len(msg.Params)-1 && (param == "" || strings.Contains(param, " ") || strings.HasPrefix(param, ":")) {
+			line.WriteByte(':')
+		}
+		line.WriteString(param)
+	}
+	return line.String()
+}
+
+// Returns the parameter at index i, empty if there are fewer parameters
+func (msg Message) Param(i int) string {
+	if i < 0 || i >= len(msg.Params) {
+		return ""
+	}
+	return msg.Params[i]
+}
+
+// Returns the last parameter, which usually is the text of the message
+func (msg Message) Trailing() string {
+	return msg.Param(len(msg.Params) - 1)
+}
+
+// Builds a message to send
+func NewMessage(command string, params ...string) Message {
+	return Message{Command: command, Params: params}
+}
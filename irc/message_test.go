@@ -0,0 +1,156 @@
+package irc
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseMessage(t *testing.T) {
+	tests := []struct {
+		name string
+		line string
+		want Message
+	}{
+		{
+			name: "escaped tag values",
+			line: `@a=b\:c\sd\\e;empty;time=2024-01-01T00:00:00.000Z :nick!user@host PRIVMSG #chan :hello world`,
+			want: Message{
+				Tags:    map[string]string{"a": `b;c d\e`, "empty": "", "time": "2024-01-01T00:00:00.000Z"},
+				Source:  "nick!user@host",
+				Nick:    "nick",
+				User:    "user",
+				Host:    "host",
+				Command: "PRIVMSG",
+				Params:  []string{"#chan", "hello world"},
+			},
+		},
+		{
+			name: "trailing backslash is dropped",
+			line: `@a=value\ PING x`,
+			want: Message{Tags: map[string]string{"a": "value"}, Command: "PING", Params: []string{"x"}},
+		},
+		{
+			name: "unknown escape loses the backslash",
+			line: `@a=\x\r\n PING x`,
+			want: Message{Tags: map[string]string{"a": "x\r\n"}, Command: "PING", Params: []string{"x"}},
+		},
+		{
+			name: "empty trailing parameter",
+			line: ":nick!user@host PRIVMSG #chan :",
+			want: Message{Source: "nick!user@host", Nick: "nick", User: "user", Host: "host", Command: "PRIVMSG", Params: []string{"#chan", ""}},
+		},
+		{
+			name: "trailing parameter starting with a colon",
+			line: "PRIVMSG #chan ::)",
+			want: Message{Command: "PRIVMSG", Params: []string{"#chan", ":)"}},
+		},
+		{
+			name: "without source",
+			line: "PING :irc.example.org",
+			want: Message{Command: "PING", Params: []string{"irc.example.org"}},
+		},
+		{
+			name: "server source",
+			line: ":irc.example.org 001 bot :Welcome",
+			want: Message{Source: "irc.example.org", Nick: "irc.example.org", Command: "001", Params: []string{"bot", "Welcome"}},
+		},
+		{
+			name: "extra spaces and lowercase command",
+			line: ":nick  mode  #chan  +o  other\r\n",
+			want: Message{Source: "nick", Nick: "nick", Command: "MODE", Params: []string{"#chan", "+o", "other"}},
+		},
+		{
+			name: "without parameters",
+			line: "QUIT",
+			want: Message{Command: "QUIT"},
+		},
+	}
+	for _, test := range tests {
+		got, err := ParseMessage(test.line)
+		if err != nil {
+			t.Errorf("%s: unexpected error: %v", test.name, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%s: ParseMessage(%q) = %#v, want %#v", test.name, test.line, got, test.want)
+		}
+	}
+}
+
+func TestParseMessageErrors(t *testing.T) {
+	for _, line := range []string{"", "@tags-only", ":source-only", "@a=b :source"} {
+		if msg, err := ParseMessage(line); err == nil {
+			t.Errorf("ParseMessage(%q) = %#v, want error", line, msg)
+		}
+	}
+}
+
+func TestMessageString(t *testing.T) {
+	tests := []struct {
+		name string
+		msg  Message
+		want string
+	}{
+		{
+			name: "escaped tags sorted",
+			msg:  Message{Tags: map[string]string{"z": "1", "a": "semi;colon space back\\slash"}, Command: "TAGMSG", Params: []string{"#chan"}},
+			want: `@a=semi\:colon\sspace\sback\\slash;z=1 TAGMSG #chan`,
+		},
+		{
+			name: "tag without value",
+			msg:  Message{Tags: map[string]string{"+typing": ""}, Command: "TAGMSG", Params: []string{"#chan"}},
+			want: "@+typing TAGMSG #chan",
+		},
+		{
+			name: "empty trailing parameter",
+			msg:  NewMessage("PRIVMSG", "#chan", ""),
+			want: "PRIVMSG #chan :",
+		},
+		{
+			name: "trailing parameter with spaces",
+			msg:  NewMessage("PRIVMSG", "#chan", "hello world"),
+			want: "PRIVMSG #chan :hello world",
+		},
+		{
+			name: "trailing parameter starting with a colon",
+			msg:  NewMessage("PRIVMSG", "#chan", ":)"),
+			want: "PRIVMSG #chan ::)",
+		},
+		{
+			name: "plain last parameter",
+			msg:  NewMessage("PONG", "irc.example.org"),
+			want: "PONG irc.example.org",
+		},
+		{
+			name: "with source",
+			msg:  Message{Source: "nick!user@host", Command: "JOIN", Params: []string{"#chan"}},
+			want: ":nick!user@host JOIN #chan",
+		},
+	}
+	for _, test := range tests {
+		if got := test.msg.String(); got != test.want {
+			t.Errorf("%s: String() = %q, want %q", test.name, got, test.want)
+		}
+	}
+}
+
+func TestMessageRoundTrip(t *testing.T) {
+	messages := []Message{
+		{Tags: map[string]string{"a": `\`, "b": `ends with\`, "c": "; \\\r\n", "d": `\:\s`}, Command: "PRIVMSG", Params: []string{"#chan", "text"}},
+		{Source: "nick!user@host", Nick: "nick", User: "user", Host: "host", Command: "PRIVMSG", Params: []string{"#chan", ""}},
+		{Source: "irc.example.org", Nick: "irc.example.org", Command: "353", Params: []string{"bot", "=", "#chan", "@op +voice user"}},
+		{Command: "PING", Params: []string{":token"}},
+		{Command: "CAP", Params: []string{"LS", "302"}},
+	}
+	for _, msg := range messages {
+		line := msg.String()
+		got, err := ParseMessage(line)
+		if err != nil {
+			t.Errorf("ParseMessage(%q): unexpected error: %v", line, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, msg) {
+			t.Errorf("round trip of %#v via %q gave %#v", msg, line, got)
+		}
+	}
+}
@@ -0,0 +1,201 @@
+package irc
+
+import (
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// How often to try getting the configured nick back while using an alternate one
+const NICK_REGAIN_INTERVAL = 2 * time.Minute
+
+// Longest nick assumed while the server did not tell its NICKLEN yet (it does after registration)
+const DEFAULT_NICKLEN = 30
+
+// Our nick: the configured one, the one in use and the alternates to fall back to if it is taken
+type nickState struct {
+	mutex      sync.Mutex
+	current    string
+	alternates []string
+	// Index of the next alternate to try while registering
+	next       int
+	registered bool
+	// Whether the server supports MONITOR (ISUPPORT), then we learn right away when the configured nick is free
+	monitor bool
+	// NICKLEN from ISUPPORT, 0 if unknown
+	length int
+	// The server refused the configured nick as erroneous, there is no point in regaining it
+	invalid bool
+}
+
+// Sets the nicks to try (in order) if the configured one is taken. Without alternates underscores are appended.
+// Needs to be called before the Eventloop is started.
+func (c *IrcClient) SetAlternateNicks(nicks []string) {
+	c.nicks.alternates = nil
+	for _, nick := range nicks {
+		if nick = strings.TrimSpace(nick); nick != "" {
+			c.nicks.alternates = append(c.nicks.alternates, nick)
+		}
+	}
+}
+
+// The nick currently in use, which is not necessarily the configured one
+func (c *IrcClient) Nick() string {
+	c.nicks.mutex.Lock()
+	defer c.nicks.mutex.Unlock()
+	return c.nicks.current
+}
+
+func (c *IrcClient) isOwnNick(nick string) bool {
+	return strings.EqualFold(nick, c.Nick())
+}
+
+// Starts a new connection with the configured nick
+func (c *IrcClient) resetNick() {
+	c.nicks.mutex.Lock()
+	defer c.nicks.mutex.Unlock()
+	c.nicks.current = c.nick
+	c.nicks.next = 0
+	c.nicks.registered = false
+	c.nicks.monitor = false
+	c.nicks.length = 0
+	c.nicks.invalid = false
+}
+
+// Takes the relevant ISUPPORT tokens, e.g. "MONITOR=100" and "NICKLEN=30"
+func (c *IrcClient) isupport(tokens []string) {
+	c.nicks.mutex.Lock()
+	defer c.nicks.mutex.Unlock()
+	for _, token := range tokens {
+		name, value, _ := strings.Cut(token, "=")
+		switch name {
+		case "MONITOR":
+			c.nicks.monitor = true
+		case "NICKLEN":
+			if length, err := strconv.Atoi(value); err == nil && length > 0 {
+				c.nicks.length = length
+			}
+		}
+	}
+}
+
+// The nick was taken (or is otherwise unavailable), erroneous if the server does not accept it at all.
+// While registering we continue with the next alternate, then with underscores appended up to NICKLEN. Without any
+// nick left we quit and the Eventloop tries again later. After registration it was an attempt to regain the
+// configured nick, which is retried later unless it is erroneous.
+func (c *IrcClient) nickRefused(nick string, reason string, erroneous bool) {
+	// Sent once the mutex is released (deferred functions run in reverse order)
+	var line string
+	defer func() {
+		if line != "" {
+			c.sendPriority(line)
+		}
+	}()
+	c.nicks.mutex.Lock()
+	defer c.nicks.mutex.Unlock()
+	if c.nicks.registered {
+		log.Println("Nick", nick, "still unavailable:", reason)
+		if erroneous && strings.EqualFold(nick, c.nick) {
+			c.nicks.invalid = true
+		}
+		return
+	}
+	length := c.nicks.length
+	if length == 0 {
+		length = DEFAULT_NICKLEN
+	}
+	var alternate string
+	switch {
+	case c.nicks.next < len(c.nicks.alternates):
+		alternate = c.nicks.alternates[c.nicks.next]
+		c.nicks.next++
+	case !erroneous && len(c.nicks.current) < length:
+		alternate = c.nicks.current + "_"
+	default:
+		log.Printf("Nick %s unavailable (%s) and no alternate left, reconnecting later", nick, reason)
+		line = "QUIT :No nick available"
+		return
+	}
+	log.Printf("Nick %s unavailable (%s), trying %s", nick, reason, alternate)
+	c.nicks.current = alternate
+	line = "NICK " + alternate
+}
+
+// Registration is done, the server tells the nick we got
+func (c *IrcClient) welcomed(nick string) {
+	c.nicks.mutex.Lock()
+	defer c.nicks.mutex.Unlock()
+	c.nicks.registered = true
+	if nick != "" {
+		c.nicks.current = nick
+	}
+	c.keepalive.setState(state_connected)
+}
+
+// Someone changed their nick. Ours is tracked, as well as the operator status of others
+func (c *IrcClient) nickChanged(old string, new string) {
+	c.operators.rename(old, new)
+	c.nicks.mutex.Lock()
+	if !strings.EqualFold(old, c.nicks.current) {
+		c.nicks.mutex.Unlock()
+		return
+	}
+	c.nicks.current = new
+	if source, ok := c.source.Load().(string); ok && source != "" {
+		_, host, _ := strings.Cut(source, "!")
+		c.source.Store(new + "!" + host)
+	}
+	monitor := c.nicks.monitor
+	c.nicks.mutex.Unlock()
+	if strings.EqualFold(new, c.nick) {
+		log.Println("Got our nick", new, "back")
+		if monitor {
+			c.sendPriority("MONITOR - " + c.nick)
+		}
+	} else {
+		log.Println("Our nick changed to", new)
+	}
+}
+
+// Watches the configured nick via MONITOR if the server supports it and we use an alternate
+func (c *IrcClient) monitorNick() {
+	c.nicks.mutex.Lock()
+	watch := c.nicks.monitor && !strings.EqualFold(c.nicks.current, c.nick)
+	c.nicks.mutex.Unlock()
+	if watch {
+		c.sendPriority("MONITOR + " + c.nick)
+	}
+}
+
+// Tries to get the configured nick back. If we identify via NickServ (not SASL), NickServ disconnects whoever
+// uses it first
+func (c *IrcClient) regainNick() {
+	c.nicks.mutex.Lock()
+	using := c.nicks.registered && !c.nicks.invalid && !strings.EqualFold(c.nicks.current, c.nick)
+	c.nicks.mutex.Unlock()
+	if !using {
+		return
+	}
+	log.Println("Trying to regain nick", c.nick)
+	if c.needsNickServ() {
+		c.sendPriority(fmt.Sprintf("PRIVMSG NickServ :GHOST %s %s", c.nick, c.password))
+	}
+	c.sendPriority("NICK " + c.nick)
+}
+
+// Periodically tries to regain the configured nick until done is closed
+func (c *IrcClient) regainLoop(done chan struct{}) {
+	ticker := time.NewTicker(NICK_REGAIN_INTERVAL)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+			c.regainNick()
+		}
+	}
+}
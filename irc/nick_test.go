@@ -0,0 +1,89 @@
+package irc
+
+import (
+	"reflect"
+	"testing"
+)
+
+// Gives the client a session without a connection, so the protocol lines it sends can be drained
+func withSession(client *IrcClient) *IrcClient {
+	client.setConnection(nil, newSession())
+	return client
+}
+
+func drain(client *IrcClient) []string {
+	var sent []string
+	for len(client.session.priority) > 0 {
+		sent = append(sent, <-client.session.priority)
+	}
+	return sent
+}
+
+func TestNickFallback(t *testing.T) {
+	tests := []struct {
+		name       string
+		alternates []string
+		length     int
+		erroneous  bool
+		want       []string
+	}{
+		{
+			name:   "underscores up to NICKLEN",
+			length: 5,
+			want:   []string{"NICK bot_", "NICK bot__", "QUIT :No nick available"},
+		},
+		{
+			name:       "alternates first",
+			alternates: []string{"troet", "troet2"},
+			length:     5,
+			want:       []string{"NICK troet", "NICK troet2", "QUIT :No nick available"},
+		},
+		{
+			name:       "erroneous nicks get no underscores",
+			alternates: []string{"troet"},
+			erroneous:  true,
+			want:       []string{"NICK troet", "QUIT :No nick available"},
+		},
+	}
+	for _, test := range tests {
+		client := withSession(newTestClient(t))
+		client.SetAlternateNicks(test.alternates)
+		client.resetNick()
+		client.nicks.length = test.length
+		var sent []string
+		for i := 0; i < 5; i++ {
+			client.nickRefused(client.Nick(), "in use", test.erroneous)
+			sent = append(sent, drain(client)...)
+		}
+		// Once out of nicks, every further refusal quits again until the server closes the connection
+		if len(sent) < len(test.want) || !reflect.DeepEqual(sent[:len(test.want)], test.want) {
+			t.Errorf("%s: sent %q, want %q", test.name, sent, test.want)
+		}
+	}
+}
+
+func TestRegainNick(t *testing.T) {
+	client := withSession(newTestClient(t))
+	client.SetPassword("secret")
+	client.resetNick()
+	client.nickRefused("bot", "in use", false)
+	client.welcomed("bot_")
+	drain(client)
+
+	client.regainNick()
+	if sent, want := drain(client), []string{"PRIVMSG NickServ :GHOST bot secret", "NICK bot"}; !reflect.DeepEqual(sent, want) {
+		t.Errorf("identified via NickServ: sent %q, want %q", sent, want)
+	}
+
+	client.caps.authenticated = true
+	client.regainNick()
+	if sent, want := drain(client), []string{"NICK bot"}; !reflect.DeepEqual(sent, want) {
+		t.Errorf("identified via SASL: sent %q, want %q", sent, want)
+	}
+
+	client.nickRefused("bot", "Erroneous nickname", true)
+	client.regainNick()
+	if sent := drain(client); len(sent) > 0 {
+		t.Errorf("erroneous nick: sent %q, want nothing", sent)
+	}
+}
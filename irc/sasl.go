@@ -0,0 +1,121 @@
+package irc
+
+import (
+	"crypto/tls"
+	"encoding/base64"
+	"fmt"
+	"log"
+	"strings"
+)
+
+// SASL mechanisms, PLAIN sends account and password, EXTERNAL uses the TLS client certificate
+const (
+	SASL_PLAIN    = "PLAIN"
+	SASL_EXTERNAL = "EXTERNAL"
+)
+
+// AUTHENTICATE payloads are sent in chunks of this size
+const sasl_chunk_length = 400
+
+// Configures SASL authentication during capability negotiation. Mechanism is SASL_PLAIN (needs the password
+// set with SetPassword) or SASL_EXTERNAL (needs a client certificate, see SetClientCertificate).
+// The account defaults to the nick. If SASL fails or the server lacks it, the bot identifies via NickServ.
+func (c *IrcClient) SetSASL(mechanism string, account string) error {
+	mechanism = strings.ToUpper(mechanism)
+	if mechanism != SASL_PLAIN && mechanism != SASL_EXTERNAL {
+		return fmt.Errorf("Unknown SASL mechanism %s, use PLAIN or EXTERNAL", mechanism)
+	}
+	if account == "" {
+		account = c.nick
+	}
+	c.saslMechanism = mechanism
+	c.saslAccount = account
+	return nil
+}
+
+// Loads the TLS client certificate presented when connecting, e.g. for SASL EXTERNAL or CertFP
+func (c *IrcClient) SetClientCertificate(certFile string, keyFile string) error {
+	if keyFile == "" {
+		// Certificate and key in one PEM file
+		keyFile = certFile
+	}
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return fmt.Errorf("Could not load client certificate: %w", err)
+	}
+	c.certificate = &cert
+	return nil
+}
+
+// Whether we want to authenticate via SASL with the mechanisms the server offers (empty if it does not tell)
+func (c *IrcClient) wantsSASL(offered string) bool {
+	if c.saslMechanism == "" || c.saslMechanism == SASL_PLAIN && c.password == "" || c.saslMechanism == SASL_EXTERNAL && c.certificate == nil {
+		return false
+	}
+	if offered == "" {
+		return true
+	}
+	for _, mechanism := range strings.Split(offered, ",") {
+		if strings.EqualFold(mechanism, c.saslMechanism) {
+			return true
+		}
+	}
+	log.Println("Server does not offer SASL", c.saslMechanism, "only", offered)
+	return false
+}
+
+// Answers the server's AUTHENTICATE challenge with our credentials
+func (c *IrcClient) authenticate() {
+	if c.saslMechanism == SASL_EXTERNAL {
+		// The certificate is the credential, nothing to send
+		c.sendPriority("AUTHENTICATE +")
+		return
+	}
+	payload := base64.StdEncoding.EncodeToString([]byte(c.saslAccount + "\x00" + c.saslAccount + "\x00" + c.password))
+	var chunks []string
+	for len(payload) >= sasl_chunk_length {
+		chunks = append(chunks, "AUTHENTICATE "+payload[:sasl_chunk_length])
+		payload = payload[sasl_chunk_length:]
+	}
+	if payload == "" {
+		// A payload of a multiple of the chunk length is terminated by an empty chunk
+		payload = "+"
+	}
+	c.sendPriority(append(chunks, "AUTHENTICATE "+payload)...)
+}
+
+// Handles the numerics ending SASL. Either way the negotiation ends, on failure NickServ is the fallback
+func (c *IrcClient) saslResult(numeric string, text string) {
+	// Sent once the mutex is released (deferred functions run in reverse order)
+	var lines []string
+	defer func() { c.sendPriority(lines...) }()
+	c.caps.mutex.Lock()
+	defer c.caps.mutex.Unlock()
+	switch numeric {
+	case "903":
+		log.Println("SASL authentication successful")
+		c.caps.authenticated = true
+	case "904":
+		log.Println("SASL authentication failed, check account and password (or certificate):", text)
+	case "905":
+		log.Println("SASL authentication failed, the credentials are too long:", text)
+	case "902":
+		log.Println("SASL authentication impossible, the nick is unavailable:", text)
+	case "906":
+		log.Println("SASL authentication aborted:", text)
+	case "907":
+		log.Println("Already authenticated via SASL")
+		c.caps.authenticated = true
+	case "908":
+		log.Println("SASL mechanism", c.saslMechanism, "not supported, server offers:", text)
+		return // 904 follows
+	}
+	lines = c.endNegotiation()
+}
+
+// Whether NickServ still has to identify us, i.e. SASL was not used or failed
+func (c *IrcClient) needsNickServ() bool {
+	c.caps.mutex.Lock()
+	defer c.caps.mutex.Unlock()
+	return !c.caps.authenticated && c.password != ""
+}
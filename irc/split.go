@@ -0,0 +1,237 @@
+package irc
+
+import (
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// IRC formatting codes
+const (
+	format_bold      = '\x02'
+	format_color     = '\x03'
+	format_hexcolor  = '\x04'
+	format_reset     = '\x0f'
+	format_mono      = '\x11'
+	format_reverse   = '\x16'
+	format_italic    = '\x1d'
+	format_strike    = '\x1e'
+	format_underline = '\x1f'
+)
+
+// Longest possible user and host part of a source (nick!user@host) if we don't know ours yet
+const max_user_length = 10
+const max_host_length = 63
+
+// A piece of text that must not be split: a grapheme cluster (a character with its combining marks, an emoji
+// sequence, ...) or a formatting code including its parameters (e.g. "\x0312,04")
+type textUnit struct {
+	text   string
+	space  bool
+	format bool
+}
+
+// The formatting in effect at some point of a line, to be restored at the start of the next part after a split
+type formatState struct {
+	toggles  map[rune]bool
+	color    string
+	hexcolor string
+}
+
+func (f *formatState) apply(code string) {
+	if f.toggles == nil {
+		f.toggles = make(map[rune]bool)
+	}
+	switch r := rune(code[0]); r {
+	case format_reset:
+		*f = formatState{toggles: make(map[rune]bool)}
+	case format_color:
+		f.color = normalizeColor(code[1:])
+	case format_hexcolor:
+		f.hexcolor = code[1:]
+	default:
+		f.toggles[r] = !f.toggles[r]
+	}
+}
+
+// Colors get two digits, so a digit following the restored code is not taken for part of the color
+func normalizeColor(color string) string {
+	if color == "" {
+		return ""
+	}
+	fg, bg, hasBg := strings.Cut(color, ",")
+	if len(fg) == 1 {
+		fg = "0" + fg
+	}
+	if hasBg && len(bg) == 1 {
+		bg = "0" + bg
+	}
+	if hasBg {
+		return fg + "," + bg
+	}
+	return fg
+}
+
+// The codes restoring the formatting at the start of a line
+func (f formatState) codes() string {
+	var codes strings.Builder
+	for _, toggle := range []rune{format_bold, format_italic, format_underline, format_strike, format_mono, format_reverse} {
+		if f.toggles[toggle] {
+			codes.WriteRune(toggle)
+		}
+	}
+	if f.color != "" {
+		codes.WriteRune(format_color)
+		codes.WriteString(f.color)
+	}
+	if f.hexcolor != "" {
+		codes.WriteRune(format_hexcolor)
+		codes.WriteString(f.hexcolor)
+	}
+	return codes.String()
+}
+
+// Splits the text into units which may not be separated
+func textUnits(text string) []textUnit {
+	var units []textUnit
+	for len(text) > 0 {
+		length := formatLength(text)
+		if length > 0 {
+			units = append(units, textUnit{text: text[:length], format: true})
+		} else {
+			length = clusterLength(text)
+			units = append(units, textUnit{text: text[:length], space: text[0] == ' '})
+		}
+		text = text[length:]
+	}
+	return units
+}
+
+// Length of the formatting code at the start of the text, 0 if there is none
+func formatLength(text string) int {
+	switch text[0] {
+	case format_bold, format_reset, format_mono, format_reverse, format_italic, format_strike, format_underline:
+		return 1
+	case format_color:
+		// \x03[fg[,bg]], one or two digits each
+		length := 1 + digits(text[1:], 2, isDigit)
+		if length > 1 && length+1 < len(text) && text[length] == ',' && isDigit(text[length+1]) {
+			length += 1 + digits(text[length+1:], 2, isDigit)
+		}
+		return length
+	case format_hexcolor:
+		// \x04[RRGGBB[,RRGGBB]]
+		length := 1
+		if digits(text[1:], 6, isHex) == 6 {
+			length += 6
+			if length+1 < len(text) && text[length] == ',' && digits(text[length+1:], 6, isHex) == 6 {
+				length += 7
+			}
+		}
+		return length
+	}
+	return 0
+}
+
+func digits(text string, max int, valid func(byte) bool) int {
+	count := 0
+	for count < max && count < len(text) && valid(text[count]) {
+		count++
+	}
+	return count
+}
+
+func isDigit(b byte) bool {
+	return b >= '0' && b <= '9'
+}
+
+func isHex(b byte) bool {
+	return isDigit(b) || b >= 'a' && b <= 'f' || b >= 'A' && b <= 'F'
+}
+
+// Length of the grapheme cluster at the start of the text. An approximation of Unicode's rules covering combining marks,
+// variation selectors, emoji modifiers, zero width joiner sequences and flags. Invalid UTF-8 counts byte by byte
+func clusterLength(text string) int {
+	first, length := utf8.DecodeRuneInString(text)
+	if first == utf8.RuneError {
+		return length
+	}
+	for length < len(text) {
+		next, size := utf8.DecodeRuneInString(text[length:])
+		switch {
+		case next == utf8.RuneError:
+			return length
+		case next == '\u200d':
+			// Zero width joiner, the following character belongs to the cluster
+			length += size
+			if length < len(text) {
+				_, joined := utf8.DecodeRuneInString(text[length:])
+				length += joined
+			}
+		case unicode.In(next, unicode.Mn, unicode.Me, unicode.Mc),
+			next >= '\ufe00' && next <= '\ufe0f',
+			next >= 0x1f3fb && next <= 0x1f3ff,
+			next >= 0xe0020 && next <= 0xe007f:
+			length += size
+		case isRegionalIndicator(first) && isRegionalIndicator(next) && length == utf8.RuneLen(first):
+			// Flags are pairs of regional indicators
+			length += size
+		default:
+			return length
+		}
+	}
+	return length
+}
+
+func isRegionalIndicator(r rune) bool {
+	return r >= 0x1f1e6 && r <= 0x1f1ff
+}
+
+// Splits a line into parts of at most max bytes. Parts end at spaces where possible (the space is dropped),
+// never inside a character, and continue the formatting of the previous part.
+func splitLine(line string, max int) []string {
+	if len(line) <= max {
+		return []string{line}
+	}
+	units := textUnits(line)
+	var parts []string
+	var state formatState
+	for i := 0; i < len(units); {
+		prefix := state.codes()
+		size := len(prefix)
+		end := i
+		lastSpace := -1
+		for end < len(units) && size+len(units[end].text) <= max {
+			if units[end].space {
+				lastSpace = end
+			}
+			size += len(units[end].text)
+			end++
+		}
+		next := end
+		if end < len(units) && units[end].space && end > i {
+			// The part ends right before a space, which is dropped
+			next = end + 1
+		} else if end < len(units) && lastSpace > i {
+			// Break at the last space instead of within a word
+			end = lastSpace
+			next = lastSpace + 1
+		}
+		if end == i {
+			// Not even one unit fits, it goes into a part of its own anyway
+			end = i + 1
+			next = end
+		}
+		var part strings.Builder
+		part.WriteString(prefix)
+		for _, unit := range units[i:end] {
+			part.WriteString(unit.text)
+			if unit.format {
+				state.apply(unit.text)
+			}
+		}
+		parts = append(parts, part.String())
+		i = next
+	}
+	return parts
+}
@@ -0,0 +1,86 @@
+package irc
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+	"unicode/utf8"
+)
+
+func TestSplitLine(t *testing.T) {
+	family := "\U0001F469\u200d\U0001F469\u200d\U0001F467"
+	tests := []struct {
+		name string
+		line string
+		max  int
+		want []string
+	}{
+		{"fits", "hello world", 20, []string{"hello world"}},
+		{"empty", "", 10, []string{""}},
+		{"at the last space", "hello world foo", 13, []string{"hello world", "foo"}},
+		{"right before a space", "hello world foo", 11, []string{"hello world", "foo"}},
+		{"within a long word", "abcdefgh", 3, []string{"abc", "def", "gh"}},
+		{"multi-byte runes", "äöü", 3, []string{"ä", "ö", "ü"}},
+		{"combining marks", "e\u0301e\u0301", 4, []string{"e\u0301", "e\u0301"}},
+		{"zero width joiner sequence", "a" + family, 18, []string{"a", family}},
+		{"flags", "\U0001F1E9\U0001F1EA\U0001F1EB\U0001F1F7", 10, []string{"\U0001F1E9\U0001F1EA", "\U0001F1EB\U0001F1F7"}},
+		{"emoji modifier", "\U0001F44D\U0001F3FDx", 8, []string{"\U0001F44D\U0001F3FD", "x"}},
+		{"variation selector", "❤\ufe0f❤\ufe0f", 6, []string{"❤\ufe0f", "❤\ufe0f"}},
+		{"invalid UTF-8 byte by byte", "a\xffb", 1, []string{"a", "\xff", "b"}},
+		{"bold carried over", "\x02bold text here", 10, []string{"\x02bold text", "\x02here"}},
+		{"open color carried over with two digits", "\x034red words", 9, []string{"\x034red", "\x0304words"}},
+		{"foreground and background", "\x033,4ab cd", 8, []string{"\x033,4ab", "\x0303,04cd"}},
+		{"several codes", "\x02\x1d\x1fab cd", 6, []string{"\x02\x1d\x1fab", "\x02\x1d\x1fcd"}},
+		{"toggled off", "\x02a\x02b cd", 5, []string{"\x02a\x02b", "cd"}},
+		{"reset", "\x02a\x0fbb cc", 7, []string{"\x02a\x0fbb", "cc"}},
+		{"color reset", "\x034a\x03b cd", 6, []string{"\x034a\x03b", "cd"}},
+		{"color code stays intact", "ab\x0312,04cd", 8, []string{"ab\x0312,04", "\x0312,04cd"}},
+		{"hex color", "\x04FF0000ab cd", 10, []string{"\x04FF0000ab", "\x04FF0000cd"}},
+	}
+	for _, test := range tests {
+		if got := splitLine(test.line, test.max); !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%s: splitLine(%q, %d) = %q, want %q", test.name, test.line, test.max, got, test.want)
+		}
+	}
+}
+
+// However the text looks, parts stay within the limit, are valid UTF-8 and together hold the complete text
+func TestSplitLineLimits(t *testing.T) {
+	line := strings.Repeat("wörd \U0001F44D\U0001F3FD \U0001F1E9\U0001F1EA e\u0301 ", 20) + strings.Repeat("x", 100)
+	for max := 12; max < 120; max += 7 {
+		var joined strings.Builder
+		for _, part := range splitLine(line, max) {
+			if len(part) > max {
+				t.Errorf("max %d: part of %d bytes: %q", max, len(part), part)
+			}
+			if !utf8.ValidString(part) {
+				t.Errorf("max %d: invalid UTF-8: %q", max, part)
+			}
+			joined.WriteString(part)
+		}
+		// Only the spaces at the breaks are dropped
+		if got, want := joined.String(), strings.ReplaceAll(line, " ", ""); strings.ReplaceAll(got, " ", "") != want {
+			t.Errorf("max %d: text changed: %q", max, got)
+		}
+	}
+}
+
+func TestSplitOverhead(t *testing.T) {
+	client := newTestClient(t)
+	if got := client.split("short\nlines", "#chan"); !reflect.DeepEqual(got, []string{"NOTICE #chan :short", "NOTICE #chan :lines"}) {
+		t.Errorf("short lines split into %q", got)
+	}
+	for _, source := range []string{"", "bot!~bot@example.org"} {
+		client.source.Store(source)
+		prefix := ":" + client.ownSource() + " "
+		lines := client.split(strings.Repeat("ä", 600), "#chan")
+		if len(lines) < 3 {
+			t.Errorf("source %q: split into %d lines", source, len(lines))
+		}
+		for _, line := range lines {
+			if relayed := len(prefix + line + "\r\n"); relayed > IRC_MESSAGE_LENGTH_MAX {
+				t.Errorf("source %q: relayed line has %d bytes", source, relayed)
+			}
+		}
+	}
+}
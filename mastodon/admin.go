@@ -0,0 +1,74 @@
+package mastodon
+
+import (
+	"LetsGoTroet/app"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// Scopes a token needs for the admin API. The bot does not request them itself,
+// for moderation provide an access token created with them
+const admin_scopes = "admin:read admin:write"
+
+// Checks if our token may use the admin API. Done by a harmless request, since the scopes of a token can't be queried
+func (mc MastodonClient) detectAdmin() bool {
+	request, err := http.NewRequest("GET", mc.endpoint(`/api/v1/admin/reports?limit=1`), nil)
+	if err != nil {
+		return false
+	}
+	_, err = mc.executeRequest(request)
+	return err == nil
+}
+
+// Performs a moderation action via the admin API. The id is an account id for approve, reject, silence and suspend
+// and a report id for resolve and assign. The text is attached to account actions.
+func (mc MastodonClient) Moderate(action app.ModerationAction, id string, text string) error {
+	if !mc.admin {
+		return fmt.Errorf("Our token for %s lacks the scopes %s", mc.homeserver, admin_scopes)
+	}
+	var path string
+	body := url.Values{}
+	switch action {
+	case app.ModerationApprove:
+		path = fmt.Sprintf(`/api/v1/admin/accounts/%s/approve`, url.PathEscape(id))
+	case app.ModerationReject:
+		path = fmt.Sprintf(`/api/v1/admin/accounts/%s/reject`, url.PathEscape(id))
+	case app.ModerationResolve:
+		path = fmt.Sprintf(`/api/v1/admin/reports/%s/resolve`, url.PathEscape(id))
+	case app.ModerationAssign:
+		path = fmt.Sprintf(`/api/v1/admin/reports/%s/assign_to_self`, url.PathEscape(id))
+	case app.ModerationSilence, app.ModerationSuspend:
+		path = fmt.Sprintf(`/api/v1/admin/accounts/%s/action`, url.PathEscape(id))
+		body.Set("type", string(action))
+		body.Set("text", text)
+	default:
+		return fmt.Errorf("Unknown moderation action %s", action)
+	}
+	request, err := http.NewRequest("POST", mc.endpoint(path), strings.NewReader(body.Encode()))
+	if err != nil {
+		return fmt.Errorf("Error building request for %s: %w", action, err)
+	}
+	if _, err = mc.executeRequest(request); err != nil {
+		return fmt.Errorf("Error during %s request: %w", action, err)
+	}
+	return nil
+}
+
+// Formats a sign up for the moderation channel
+func formatSignUp(acc account) string {
+	return fmt.Sprintf("New sign up: %s (%s), account id %s", acc.Account, acc.DisplayName, acc.Id)
+}
+
+// Formats a report for the moderation channel
+func formatReport(r report) string {
+	output := fmt.Sprintf("New report %s (%s) against %s (account id %s)", r.Id, r.Category, r.TargetAccount.Account, r.TargetAccount.Id)
+	if r.Comment != "" {
+		output += fmt.Sprintf("\n> %s", strings.Join(strings.Split(r.Comment, "\n"), "\n> "))
+	}
+	if len(r.StatusIds) > 0 {
+		output += fmt.Sprintf("\nReported statuses: %s", strings.Join(r.StatusIds, ", "))
+	}
+	return output
+}
@@ -0,0 +1,126 @@
+package mastodon
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+)
+
+// Relayed toots are checked for deletion for this long after they were stored
+const deletion_window = 24 * time.Hour
+
+// At most this many toots are checked per round, the most recently stored first
+const deletion_checks = 30
+
+// Every this many rounds of the eventloop relayed toots are checked for deletion
+const deletion_check_rounds = 20
+
+// Handles an edited toot: the new content is compared to what we stored, the stored content is updated.
+// Returns the message describing the edit, empty if nothing relevant changed.
+func (mc MastodonClient) handleUpdate(toot status) (string, string, error) {
+	shorthand := encodeId(mc.owner() + "/" + toot.Id)
+	row := mc.database.QueryRow("SELECT content FROM messages_mastodon WHERE shorthand=?;", shorthand)
+	var stored string
+	known := row.Scan(&stored) == nil
+	if known && stored == toot.Content {
+		return "", shorthand, nil
+	}
+	if _, err := mc.storeMessage(toot); err != nil {
+		return "", shorthand, err
+	}
+	if !known {
+		formatted, err := mc.GetMessage(shorthand)
+		if err != nil {
+			return "", shorthand, err
+		}
+		return "Edited: " + formatted, shorthand, nil
+	}
+	return fmt.Sprintf("[%s] Toot by %s was edited:\n> %s\n%s", shorthand, toot.Account.Account, wordDiff(plainText(stored), plainText(toot.Content)), toot.Url), shorthand, nil
+}
+
+// Marks the toot behind the shorthand as deleted. The key stays known, but only tells that the toot is gone
+func (mc MastodonClient) markDead(shorthand string) {
+	if _, err := mc.database.Exec("UPDATE messages_mastodon SET dead=1 WHERE shorthand=?;", shorthand); err != nil {
+		log.Println("Error marking", shorthand, "as deleted:", err)
+	}
+}
+
+// Checks the recently relayed toots for deletion and hands deleted ones to the notificationHandler as "delete"
+func (mc MastodonClient) checkDeletions() {
+	rows, err := mc.database.Query("SELECT shorthand, tootid, content FROM messages_mastodon WHERE account=? AND dead=0 AND time>? ORDER BY time DESC LIMIT ?;", mc.owner(), time.Now().Add(-deletion_window), deletion_checks)
+	if err != nil {
+		log.Println("Error listing toots to check for deletion:", err)
+		return
+	}
+	type stored struct{ shorthand, tootid, content string }
+	var toots []stored
+	for rows.Next() {
+		var toot stored
+		if err := rows.Scan(&toot.shorthand, &toot.tootid, &toot.content); err == nil {
+			toots = append(toots, toot)
+		}
+	}
+	rows.Close()
+	for _, toot := range toots {
+		if _, err := mc.getStatus(toot.tootid); isGone(err) {
+			mc.markDead(toot.shorthand)
+			mc.notificationHandler("delete", fmt.Sprintf("[%s] Toot was deleted: %s", toot.shorthand, snippet(toot.content, snippet_length)), toot.shorthand)
+		}
+	}
+}
+
+// Whether a request failed because the toot does not exist (any more)
+func isGone(err error) bool {
+	var status httpError
+	return errors.As(err, &status) && (status == 404 || status == 410)
+}
+
+// Marks the words removed from old as [-word-] and the added ones as {+word+}, like git diff --word-diff
+func wordDiff(old string, new string) string {
+	a := strings.Fields(old)
+	b := strings.Fields(new)
+	// Longest common subsequence, lcs[i][j] for the suffixes a[i:] and b[j:]
+	lcs := make([][]int, len(a)+1)
+	for i := range lcs {
+		lcs[i] = make([]int, len(b)+1)
+	}
+	for i := len(a) - 1; i >= 0; i-- {
+		for j := len(b) - 1; j >= 0; j-- {
+			if a[i] == b[j] {
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			} else {
+				lcs[i][j] = max(lcs[i+1][j], lcs[i][j+1])
+			}
+		}
+	}
+	var words, removed, added []string
+	flush := func() {
+		if len(removed) > 0 {
+			words = append(words, "[-"+strings.Join(removed, " ")+"-]")
+		}
+		if len(added) > 0 {
+			words = append(words, "{+"+strings.Join(added, " ")+"+}")
+		}
+		removed, added = nil, nil
+	}
+	i, j := 0, 0
+	for i < len(a) || j < len(b) {
+		switch {
+		case i < len(a) && j < len(b) && a[i] == b[j]:
+			flush()
+			words = append(words, a[i])
+			i++
+			j++
+		case j == len(b) || i < len(a) && lcs[i+1][j] >= lcs[i][j+1]:
+			removed = append(removed, a[i])
+			i++
+		default:
+			added = append(added, b[j])
+			j++
+		}
+	}
+	flush()
+	return strings.Join(words, " ")
+}
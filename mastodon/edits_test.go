@@ -0,0 +1,29 @@
+package mastodon
+
+import "testing"
+
+func TestWordDiff(t *testing.T) {
+	tests := []struct {
+		name string
+		old  string
+		new  string
+		want string
+	}{
+		{"unchanged", "open today", "open today", "open today"},
+		{"word replaced", "open today", "open tomorrow", "open [-today-] {+tomorrow+}"},
+		{"word added", "open today", "open today until 18", "open today {+until 18+}"},
+		{"word removed", "we are open today", "open today", "[-we are-] open today"},
+		{"several changes", "a b c d", "a x c y", "a [-b-] {+x+} c [-d-] {+y+}"},
+		{"whitespace only", "open  today\n", "open today", "open today"},
+		{"from empty", "", "hello world", "{+hello world+}"},
+		{"to empty", "hello world", "", "[-hello world-]"},
+		{"both empty", "", "", ""},
+		{"repeated words", "la la la", "la la", "la la [-la-]"},
+		{"everything replaced", "foo bar", "baz qux", "[-foo bar-] {+baz qux+}"},
+	}
+	for _, test := range tests {
+		if got := wordDiff(test.old, test.new); got != test.want {
+			t.Errorf("%s: wordDiff(%q, %q) = %q, want %q", test.name, test.old, test.new, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,240 @@
+package mastodon
+
+import (
+	"LetsGoTroet/app"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Filters are cached, changes made elsewhere (e.g. in the web interface) show up after this interval
+const filter_refresh = 5 * time.Minute
+
+// Keywords added via IRC go into filters with these titles, created on demand
+var own_filters = map[app.FilterAction]string{
+	app.FilterWarn: "LetsGoTroet",
+	app.FilterHide: "LetsGoTroet (hidden)",
+}
+
+// The contexts our own filters apply in
+var own_filter_context = []string{"home", "notifications", "public", "thread"}
+
+type filter struct {
+	Id           string          `json:"id"`
+	Title        string          `json:"title"`
+	Context      []string        `json:"context"`
+	ExpiresAt    *time.Time      `json:"expires_at"`
+	FilterAction string          `json:"filter_action"`
+	Keywords     []filterKeyword `json:"keywords"`
+}
+
+type filterKeyword struct {
+	Id        string `json:"id"`
+	Keyword   string `json:"keyword"`
+	WholeWord bool   `json:"whole_word"`
+}
+
+type filterCache struct {
+	mutex   sync.Mutex
+	filters []filter
+	fetched time.Time
+}
+
+// Checks a stored toot against the filters of our account. Mentions are checked in the notifications context,
+// everything else in the home timeline context. Only the first matching filter is returned.
+func (mc MastodonClient) MatchFilter(messageID string, kind string) (app.FilterMatch, bool) {
+	if mc.instance != nil && !mc.instance.Features[featureFilters] {
+		return app.FilterMatch{}, false
+	}
+	var text string
+	if toot, err := mc.lookupShorthand(messageID); err == nil {
+		text = plainText(toot.SpoilerText) + "\n" + plainText(toot.Content)
+	} else {
+		// Deleted toots are checked against what we stored of them
+		row := mc.database.QueryRow("SELECT content FROM messages_mastodon WHERE shorthand=? AND (account=? OR account='');", messageID, mc.owner())
+		var stored string
+		if row.Scan(&stored) != nil {
+			return app.FilterMatch{}, false
+		}
+		text = plainText(stored)
+	}
+	context := "home"
+	if kind == "mention" {
+		context = "notifications"
+	}
+	now := time.Now()
+	for _, f := range mc.cachedFilters() {
+		if f.ExpiresAt != nil && f.ExpiresAt.Before(now) || !contains(f.Context, context) {
+			continue
+		}
+		for _, keyword := range f.Keywords {
+			if keyword.matches(text) {
+				action := app.FilterWarn
+				if f.FilterAction == "hide" {
+					action = app.FilterHide
+				}
+				return app.FilterMatch{Title: f.Title, Keyword: keyword.Keyword, Action: action}, true
+			}
+		}
+	}
+	return app.FilterMatch{}, false
+}
+
+func (keyword filterKeyword) matches(text string) bool {
+	pattern := regexp.QuoteMeta(keyword.Keyword)
+	if keyword.WholeWord {
+		pattern = `\b` + pattern + `\b`
+	}
+	matched, err := regexp.MatchString(`(?i)`+pattern, text)
+	return err == nil && matched
+}
+
+func contains(list []string, value string) bool {
+	for _, entry := range list {
+		if entry == value {
+			return true
+		}
+	}
+	return false
+}
+
+// Returns the filters, fetching them again if the cache is stale. If fetching fails the old filters stay in use.
+func (mc MastodonClient) cachedFilters() []filter {
+	mc.filters.mutex.Lock()
+	defer mc.filters.mutex.Unlock()
+	if time.Since(mc.filters.fetched) < filter_refresh {
+		return mc.filters.filters
+	}
+	filters, err := mc.getFilters()
+	if err != nil {
+		log.Println("Error getting filters:", err)
+	} else {
+		mc.filters.filters = filters
+	}
+	mc.filters.fetched = time.Now()
+	return mc.filters.filters
+}
+
+// Makes the next check fetch the filters again
+func (mc MastodonClient) invalidateFilters() {
+	mc.filters.mutex.Lock()
+	defer mc.filters.mutex.Unlock()
+	mc.filters.fetched = time.Time{}
+}
+
+func (mc MastodonClient) Filters() ([]app.Filter, error) {
+	if err := mc.require(featureFilters); err != nil {
+		return nil, err
+	}
+	filters, err := mc.getFilters()
+	if err != nil {
+		return nil, err
+	}
+	var result []app.Filter
+	for _, f := range filters {
+		action := app.FilterWarn
+		if f.FilterAction == "hide" {
+			action = app.FilterHide
+		}
+		converted := app.Filter{Title: f.Title, Action: action, Context: f.Context}
+		for _, keyword := range f.Keywords {
+			converted.Keywords = append(converted.Keywords, keyword.Keyword)
+		}
+		result = append(result, converted)
+	}
+	return result, nil
+}
+
+// Adds the keyword to our own filter for the action, creating the filter if needed
+func (mc MastodonClient) AddFilter(keyword string, action app.FilterAction) error {
+	if err := mc.require(featureFilters); err != nil {
+		return err
+	}
+	title, known := own_filters[action]
+	if !known {
+		return fmt.Errorf("Unknown filter action %s", action)
+	}
+	filters, err := mc.getFilters()
+	if err != nil {
+		return err
+	}
+	defer mc.invalidateFilters()
+	for _, f := range filters {
+		if f.Title == title {
+			body := url.Values{
+				"keyword":    {keyword},
+				"whole_word": {"true"},
+			}
+			return mc.filterRequest("POST", mc.endpoint(`/api/v2/filters/%s/keywords`, url.PathEscape(f.Id)), body)
+		}
+	}
+	body := url.Values{
+		"title":                             {title},
+		"context[]":                         own_filter_context,
+		"filter_action":                     {string(action)},
+		"keywords_attributes[][keyword]":    {keyword},
+		"keywords_attributes[][whole_word]": {"true"},
+	}
+	return mc.filterRequest("POST", mc.endpoint(`/api/v2/filters`), body)
+}
+
+// Removes the keyword from every filter containing it
+func (mc MastodonClient) RemoveFilter(keyword string) error {
+	if err := mc.require(featureFilters); err != nil {
+		return err
+	}
+	filters, err := mc.getFilters()
+	if err != nil {
+		return err
+	}
+	defer mc.invalidateFilters()
+	removed := false
+	for _, f := range filters {
+		for _, k := range f.Keywords {
+			if !strings.EqualFold(k.Keyword, keyword) {
+				continue
+			}
+			if err := mc.filterRequest("DELETE", mc.endpoint(`/api/v2/filters/keywords/%s`, url.PathEscape(k.Id)), url.Values{}); err != nil {
+				return err
+			}
+			removed = true
+		}
+	}
+	if !removed {
+		return fmt.Errorf("No filter contains %s", keyword)
+	}
+	return nil
+}
+
+func (mc MastodonClient) filterRequest(method string, endpoint string, body url.Values) error {
+	request, err := http.NewRequest(method, endpoint, strings.NewReader(body.Encode()))
+	if err != nil {
+		return fmt.Errorf("Error building request for filter: %w", err)
+	}
+	if _, err = mc.executeRequest(request); err != nil {
+		return fmt.Errorf("Error during filter request: %w", err)
+	}
+	return nil
+}
+
+func (mc MastodonClient) getFilters() ([]filter, error) {
+	request, err := http.NewRequest("GET", mc.endpoint(`/api/v2/filters`), nil)
+	if err != nil {
+		return nil, fmt.Errorf("Error building request for filters: %w", err)
+	}
+	respBody, err := mc.executeRequest(request)
+	if err != nil {
+		return nil, fmt.Errorf("Error during filters request: %w", err)
+	}
+	var filters []filter
+	if err = json.Unmarshal(respBody, &filters); err != nil {
+		return nil, fmt.Errorf("Error unmarshalling filters: %w", err)
+	}
+	return filters, nil
+}
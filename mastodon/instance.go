@@ -0,0 +1,344 @@
+package mastodon
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// Features which not every server implementing the Mastodon API supports
+const (
+	featureBookmarks     = "bookmarks"
+	featurePins          = "pins"
+	featureConversations = "conversations"
+	featurePolls         = "polls"
+	featureDomainBlocks  = "domain blocks"
+	featureFilters       = "filters"
+)
+
+// Nodeinfo documents are small, anything larger is not read completely
+const nodeinfo_max_size = 1 << 20
+
+// What we know about the server software and its limits.
+// Discovered on startup via nodeinfo and /api/v2/instance (or /api/v1/instance for older servers)
+type instance struct {
+	Software string
+	Version  string
+	// Limits, 0 if unknown
+	MaxCharacters      int
+	MaxAttachments     int
+	ImageSizeLimit     int
+	VideoSizeLimit     int
+	MaxPollOptions     int
+	MaxPollOptionChars int
+	MinPollExpiration  int
+	MaxPollExpiration  int
+	Features           map[string]bool
+}
+
+type nodeinfoLinks struct {
+	Links []struct {
+		Rel  string `json:"rel"`
+		Href string `json:"href"`
+	} `json:"links"`
+}
+
+type nodeinfo struct {
+	Software struct {
+		Name    string `json:"name"`
+		Version string `json:"version"`
+	} `json:"software"`
+}
+
+// The parts of the configuration shared by the v1 and v2 instance entities of Mastodon
+type instanceConfiguration struct {
+	Statuses struct {
+		MaxCharacters  int `json:"max_characters"`
+		MaxAttachments int `json:"max_media_attachments"`
+	} `json:"statuses"`
+	MediaAttachments struct {
+		ImageSizeLimit int `json:"image_size_limit"`
+		VideoSizeLimit int `json:"video_size_limit"`
+	} `json:"media_attachments"`
+	Polls struct {
+		MaxOptions             int `json:"max_options"`
+		MaxCharactersPerOption int `json:"max_characters_per_option"`
+		MinExpiration          int `json:"min_expiration"`
+		MaxExpiration          int `json:"max_expiration"`
+	} `json:"polls"`
+}
+
+type instanceReply struct {
+	Configuration instanceConfiguration `json:"configuration"`
+	// Pleroma and Akkoma announce their limits differently
+	MaxTootChars int `json:"max_toot_chars"`
+	PollLimits   struct {
+		MaxOptions     int `json:"max_options"`
+		MaxOptionChars int `json:"max_option_chars"`
+		MinExpiration  int `json:"min_expiration"`
+		MaxExpiration  int `json:"max_expiration"`
+	} `json:"poll_limits"`
+}
+
+// Minimum versions of the server software supporting a feature. Software not listed here is assumed to support everything,
+// features missing for a listed software are not supported by it
+var featureVersions = map[string]map[string]string{
+	"mastodon": {
+		featureBookmarks:     "3.1.0",
+		featurePins:          "1.6.0",
+		featureConversations: "2.6.0",
+		featurePolls:         "2.8.0",
+		featureDomainBlocks:  "1.4.0",
+		featureFilters:       "4.0.0",
+	},
+	"glitch-soc": {
+		featureBookmarks:     "3.1.0",
+		featurePins:          "1.6.0",
+		featureConversations: "2.6.0",
+		featurePolls:         "2.8.0",
+		featureDomainBlocks:  "1.4.0",
+		featureFilters:       "4.0.0",
+	},
+	"gotosocial": {
+		featureBookmarks:     "0.6.0",
+		featurePins:          "0.10.0",
+		featureConversations: "0.17.0",
+		featurePolls:         "0.14.0",
+		featureFilters:       "0.16.0",
+	},
+	"pleroma": {
+		featureBookmarks:     "2.0.0",
+		featurePins:          "0.9.0",
+		featureConversations: "1.0.0",
+		featurePolls:         "1.0.0",
+		featureDomainBlocks:  "1.0.0",
+	},
+	"akkoma": {
+		featureBookmarks:     "0.0.0",
+		featurePins:          "0.0.0",
+		featureConversations: "0.0.0",
+		featurePolls:         "0.0.0",
+		featureDomainBlocks:  "0.0.0",
+	},
+}
+
+// Finds out which software the server runs and its limits. Failing discovery is not fatal,
+// we then assume a recent vanilla Mastodon without known limits.
+func (mc MastodonClient) discoverInstance() *instance {
+	inst := &instance{
+		Software: "mastodon",
+		Version:  "",
+	}
+	software, version, err := mc.getNodeinfo()
+	if err != nil {
+		log.Println("Could not discover server software, assuming Mastodon:", err)
+	} else {
+		inst.Software = software
+		inst.Version = version
+		if software == "mastodon" && strings.Contains(version, "+glitch") {
+			inst.Software = "glitch-soc"
+		}
+	}
+	config, err := mc.getInstance()
+	if err != nil {
+		log.Println("Could not discover instance limits:", err)
+	} else {
+		inst.MaxCharacters = config.Configuration.Statuses.MaxCharacters
+		inst.MaxAttachments = config.Configuration.Statuses.MaxAttachments
+		inst.ImageSizeLimit = config.Configuration.MediaAttachments.ImageSizeLimit
+		inst.VideoSizeLimit = config.Configuration.MediaAttachments.VideoSizeLimit
+		inst.MaxPollOptions = config.Configuration.Polls.MaxOptions
+		inst.MaxPollOptionChars = config.Configuration.Polls.MaxCharactersPerOption
+		inst.MinPollExpiration = config.Configuration.Polls.MinExpiration
+		inst.MaxPollExpiration = config.Configuration.Polls.MaxExpiration
+		if inst.MaxCharacters == 0 {
+			inst.MaxCharacters = config.MaxTootChars
+		}
+		if inst.MaxPollOptions == 0 {
+			inst.MaxPollOptions = config.PollLimits.MaxOptions
+			inst.MaxPollOptionChars = config.PollLimits.MaxOptionChars
+			inst.MinPollExpiration = config.PollLimits.MinExpiration
+			inst.MaxPollExpiration = config.PollLimits.MaxExpiration
+		}
+	}
+	inst.Features = make(map[string]bool)
+	for _, feature := range []string{featureBookmarks, featurePins, featureConversations, featurePolls, featureDomainBlocks, featureFilters} {
+		inst.Features[feature] = supports(inst.Software, inst.Version, feature)
+	}
+	log.Println("Mastodon server:", inst.describe())
+	return inst
+}
+
+func supports(software string, version string, feature string) bool {
+	minimums, known := featureVersions[software]
+	if !known {
+		return true
+	}
+	minimum, listed := minimums[feature]
+	if !listed {
+		return false
+	}
+	if version == "" {
+		// Unknown version, better try than refuse
+		return true
+	}
+	return compareVersions(version, minimum) >= 0
+}
+
+// Compares the numeric major.minor.patch part of two versions, anything after (like "+glitch" or "-rc1") is ignored
+func compareVersions(a string, b string) int {
+	pa := versionParts(a)
+	pb := versionParts(b)
+	for i := 0; i < 3; i++ {
+		if pa[i] != pb[i] {
+			return pa[i] - pb[i]
+		}
+	}
+	return 0
+}
+
+func versionParts(version string) [3]int {
+	var parts [3]int
+	for i, part := range strings.SplitN(version, ".", 3) {
+		end := strings.IndexFunc(part, func(r rune) bool { return r < '0' || r > '9' })
+		if end >= 0 {
+			part = part[:end]
+		}
+		parts[i], _ = strconv.Atoi(part)
+	}
+	return parts
+}
+
+// Returns an error explaining that the server does not support the feature
+func (mc MastodonClient) require(feature string) error {
+	if mc.instance == nil || mc.instance.Features[feature] {
+		return nil
+	}
+	return fmt.Errorf("%s are not supported by %s", feature, mc.instance.software())
+}
+
+// Checks the status text against the character limit of the server
+func (mc MastodonClient) checkLength(message string) error {
+	if mc.instance == nil || mc.instance.MaxCharacters == 0 {
+		return nil
+	}
+	if length := utf8.RuneCountInString(message); length > mc.instance.MaxCharacters {
+		return fmt.Errorf("Toot too long: %d characters, %s allows %d", length, mc.homeserver, mc.instance.MaxCharacters)
+	}
+	return nil
+}
+
+func (inst instance) software() string {
+	if inst.Version == "" {
+		return inst.Software
+	}
+	return inst.Software + " " + inst.Version
+}
+
+func (inst instance) describe() string {
+	var unsupported []string
+	for feature, supported := range inst.Features {
+		if !supported {
+			unsupported = append(unsupported, feature)
+		}
+	}
+	sort.Strings(unsupported)
+	description := inst.software()
+	if inst.MaxCharacters > 0 {
+		description += fmt.Sprintf(", %d characters", inst.MaxCharacters)
+	}
+	if inst.MaxPollOptions > 0 {
+		description += fmt.Sprintf(", %d poll options", inst.MaxPollOptions)
+	}
+	if len(unsupported) > 0 {
+		description += ", unsupported: " + strings.Join(unsupported, ", ")
+	}
+	return description
+}
+
+// Reads the software name and version from nodeinfo. Nodeinfo is public, the token is not sent along
+func (mc MastodonClient) getNodeinfo() (string, string, error) {
+	respBody, err := mc.getPublic(mc.endpoint(`/.well-known/nodeinfo`))
+	if err != nil {
+		return "", "", fmt.Errorf("Error during nodeinfo request: %w", err)
+	}
+	var links nodeinfoLinks
+	if err = json.Unmarshal(respBody, &links); err != nil {
+		return "", "", fmt.Errorf("Error unmarshalling nodeinfo links: %w", err)
+	}
+	href := ""
+	for _, link := range links.Links {
+		if strings.HasPrefix(link.Rel, "http://nodeinfo.diaspora.software/ns/schema/2.") {
+			href = link.Href
+		}
+	}
+	if href == "" {
+		return "", "", fmt.Errorf("No nodeinfo 2.x announced")
+	}
+	// The announced document has to be on our instance, we don't follow the server elsewhere
+	announced, err := url.Parse(href)
+	if err != nil || announced.Scheme != mc.baseurl.Scheme || !strings.EqualFold(announced.Host, mc.baseurl.Host) {
+		return "", "", fmt.Errorf("Nodeinfo announced on another host: %s", href)
+	}
+	respBody, err = mc.getPublic(announced.String())
+	if err != nil {
+		return "", "", fmt.Errorf("Error during nodeinfo request: %w", err)
+	}
+	var info nodeinfo
+	if err = json.Unmarshal(respBody, &info); err != nil {
+		return "", "", fmt.Errorf("Error unmarshalling nodeinfo: %w", err)
+	}
+	return strings.ToLower(info.Software.Name), info.Software.Version, nil
+}
+
+// GETs a public document without authorization
+func (mc MastodonClient) getPublic(link string) ([]byte, error) {
+	request, err := http.NewRequest("GET", link, nil)
+	if err != nil {
+		return nil, fmt.Errorf("Error building request: %w", err)
+	}
+	resp, err := mc.client.Do(request)
+	if err != nil {
+		return nil, fmt.Errorf("Error in client.Do: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != 200 {
+		return nil, httpError(resp.StatusCode)
+	}
+	respBody, err := io.ReadAll(io.LimitReader(resp.Body, nodeinfo_max_size))
+	if err != nil {
+		return nil, fmt.Errorf("Error reading response: %w", err)
+	}
+	return respBody, nil
+}
+
+// Gets the instance entity, v2 first and v1 for older servers
+func (mc MastodonClient) getInstance() (*instanceReply, error) {
+	var respBody []byte
+	var err error
+	for _, version := range []string{"v2", "v1"} {
+		var request *http.Request
+		request, err = http.NewRequest("GET", mc.endpoint(`/api/%s/instance`, version), strings.NewReader(""))
+		if err != nil {
+			return nil, fmt.Errorf("Error building request for instance: %w", err)
+		}
+		if respBody, err = mc.executeRequest(request); err == nil {
+			break
+		}
+	}
+	if err != nil {
+		return nil, fmt.Errorf("Error during instance request: %w", err)
+	}
+	var reply instanceReply
+	if err = json.Unmarshal(respBody, &reply); err != nil {
+		return nil, fmt.Errorf("Error unmarshalling instance: %w", err)
+	}
+	return &reply, nil
+}
@@ -0,0 +1,56 @@
+package mastodon
+
+import "testing"
+
+func TestVersionParts(t *testing.T) {
+	tests := []struct {
+		name    string
+		version string
+		want    [3]int
+	}{
+		{"full", "4.2.10", [3]int{4, 2, 10}},
+		{"major only", "4", [3]int{4, 0, 0}},
+		{"major and minor", "3.5", [3]int{3, 5, 0}},
+		{"glitch suffix", "4.2.1+glitch", [3]int{4, 2, 1}},
+		{"release candidate", "4.3.0-rc.1", [3]int{4, 3, 0}},
+		{"suffix on minor", "0.15rc2", [3]int{0, 15, 0}},
+		{"more than three parts", "2.5.0.1", [3]int{2, 5, 0}},
+		{"empty", "", [3]int{0, 0, 0}},
+		{"garbage", "unknown", [3]int{0, 0, 0}},
+	}
+	for _, test := range tests {
+		if got := versionParts(test.version); got != test.want {
+			t.Errorf("%s: versionParts(%q) = %v, want %v", test.name, test.version, got, test.want)
+		}
+	}
+}
+
+func TestCompareVersions(t *testing.T) {
+	tests := []struct {
+		name string
+		a    string
+		b    string
+		want int
+	}{
+		{"equal", "4.0.0", "4.0.0", 0},
+		{"newer major", "4.0.0", "3.5.0", 1},
+		{"older minor", "3.1.0", "3.5.0", -1},
+		{"newer patch", "3.5.3", "3.5.0", 1},
+		{"numeric not lexical", "3.10.0", "3.9.0", 1},
+		{"missing parts count as zero", "4", "4.0.0", 0},
+		{"suffixes ignored", "4.2.0+glitch", "4.2.0", 0},
+		{"release candidate counts as release", "4.3.0-rc.1", "4.3.0", 0},
+	}
+	for _, test := range tests {
+		got := compareVersions(test.a, test.b)
+		// Only the sign matters
+		if got > 0 {
+			got = 1
+		} else if got < 0 {
+			got = -1
+		}
+		if got != test.want {
+			t.Errorf("%s: compareVersions(%q, %q) = %d, want %d", test.name, test.a, test.b, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,222 @@
+package mastodon
+
+import (
+	"LetsGoTroet/app"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"syscall"
+	"time"
+)
+
+const oob_redirect = "urn:ietf:wg:oauth:2.0:oob"
+
+// Personal accounts only get to post and interact, no push or admin scopes
+const link_scopes = "read write"
+
+// Links the Mastodon accounts of individual users via OAuth (out of band, the user copies the code).
+// Implements app.Linker
+type Linker struct {
+	client   *http.Client
+	database *sql.DB
+}
+
+// Intermediate state between StartLink and FinishLink
+type linkState struct {
+	Instance     string `json:"instance"`
+	ClientId     string `json:"client_id"`
+	ClientSecret string `json:"client_secret"`
+}
+
+// What is needed to act as a linked account
+type linkCredential struct {
+	Instance    string `json:"instance"`
+	AccessToken string `json:"access_token"`
+}
+
+// Shared address space for carrier-grade NAT (RFC 6598), not covered by net.IP.IsPrivate
+var shared_address_space = &net.IPNet{IP: net.IPv4(100, 64, 0, 0), Mask: net.CIDRMask(10, 32)}
+
+// Instances are given by IRC users, so linking and the linked accounts use their own HTTP client (see newPublicClient)
+func NewLinker(database *sql.DB) *Linker {
+	return &Linker{
+		client:   newPublicClient(),
+		database: database,
+	}
+}
+
+// Client for URLs given by IRC users. It always verifies TLS (regardless of MASTODON_INSECURE and MASTODON_CA_FILE),
+// uses no proxy, only connects to public addresses and follows redirects only to https
+func newPublicClient() *http.Client {
+	dialer := &net.Dialer{
+		Timeout: 30 * time.Second,
+		// Checked for every connection, after name resolution and on redirects as well
+		Control: func(network string, address string, _ syscall.RawConn) error {
+			host, _, err := net.SplitHostPort(address)
+			if err != nil {
+				return err
+			}
+			if ip := net.ParseIP(host); ip == nil || !isPublic(ip) {
+				return fmt.Errorf("Refusing to connect to non-public address %s", host)
+			}
+			return nil
+		},
+	}
+	transport := &http.Transport{
+		DialContext:         dialer.DialContext,
+		TLSHandshakeTimeout: 10 * time.Second,
+		ForceAttemptHTTP2:   true,
+	}
+	return &http.Client{
+		Transport: transport,
+		Timeout:   time.Minute,
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			if req.URL.Scheme != "https" {
+				return errors.New("Refusing redirect away from https")
+			}
+			if len(via) >= 10 {
+				return errors.New("Too many redirects")
+			}
+			return nil
+		},
+	}
+}
+
+func isPublic(ip net.IP) bool {
+	return !(ip.IsLoopback() || ip.IsPrivate() || ip.IsUnspecified() || ip.IsLinkLocalUnicast() ||
+		ip.IsLinkLocalMulticast() || ip.IsInterfaceLocalMulticast() || ip.IsMulticast() || shared_address_space.Contains(ip))
+}
+
+// Parses an instance given by a user. Only https and hosts which are not obviously internal are accepted,
+// the addresses a host name resolves to are checked when connecting
+func parseInstance(instance string) (*url.URL, error) {
+	base, err := parseBaseURL(instance)
+	if err != nil {
+		return nil, err
+	}
+	if err := checkPublicURL(base); err != nil {
+		return nil, fmt.Errorf("Invalid instance %s: %w", instance, err)
+	}
+	return base, nil
+}
+
+// Accepts https URLs to hosts which are not obviously internal
+func checkPublicURL(link *url.URL) error {
+	if link.Scheme != "https" {
+		return errors.New("only https is supported")
+	}
+	host := strings.ToLower(strings.TrimSuffix(link.Hostname(), "."))
+	if host == "" || host == "localhost" || strings.HasSuffix(host, ".localhost") {
+		return errors.New("not a public host")
+	}
+	if ip := net.ParseIP(host); ip != nil && !isPublic(ip) {
+		return errors.New("not a public address")
+	}
+	return nil
+}
+
+// Registers the bot as app on the instance and returns the URL where the user authorizes it
+func (l Linker) StartLink(instance string) (string, string, error) {
+	base, err := parseInstance(instance)
+	if err != nil {
+		return "", "", err
+	}
+	reply, err := l.client.PostForm(endpoint(base, `/api/v1/apps`), url.Values{
+		"client_name":   {"LetsGoTroet"},
+		"redirect_uris": {oob_redirect},
+		"scopes":        {link_scopes},
+	})
+	if err != nil {
+		return "", "", fmt.Errorf("Error registering app on %s: %w", instance, err)
+	}
+	defer reply.Body.Close()
+	if reply.StatusCode != 200 {
+		return "", "", fmt.Errorf("Error registering app on %s: %d", instance, reply.StatusCode)
+	}
+	body, err := io.ReadAll(reply.Body)
+	if err != nil {
+		return "", "", err
+	}
+	var appsResponse appsReply
+	if err = json.Unmarshal(body, &appsResponse); err != nil {
+		return "", "", fmt.Errorf("Error unmarshalling /v1/apps response: %w", err)
+	}
+	state, err := json.Marshal(linkState{
+		Instance:     instance,
+		ClientId:     appsResponse.ClientId,
+		ClientSecret: appsResponse.ClientSecret,
+	})
+	if err != nil {
+		return "", "", err
+	}
+	authorize := endpoint(base, `/oauth/authorize?%s`, url.Values{
+		"client_id":     {appsResponse.ClientId},
+		"redirect_uri":  {oob_redirect},
+		"response_type": {"code"},
+		"scope":         {link_scopes},
+	}.Encode())
+	return authorize, string(state), nil
+}
+
+// Exchanges the authorization code for an access token
+func (l Linker) FinishLink(state string, code string) (string, error) {
+	var link linkState
+	if err := json.Unmarshal([]byte(state), &link); err != nil {
+		return "", fmt.Errorf("Invalid link state: %w", err)
+	}
+	base, err := parseInstance(link.Instance)
+	if err != nil {
+		return "", err
+	}
+	reply, err := l.client.PostForm(endpoint(base, `/oauth/token`), url.Values{
+		"client_id":     {link.ClientId},
+		"client_secret": {link.ClientSecret},
+		"redirect_uri":  {oob_redirect},
+		"grant_type":    {"authorization_code"},
+		"code":          {code},
+		"scope":         {link_scopes},
+	})
+	if err != nil {
+		return "", err
+	}
+	defer reply.Body.Close()
+	if reply.StatusCode != 200 {
+		return "", fmt.Errorf("Authorization failed (%d), was the code correct?", reply.StatusCode)
+	}
+	body, err := io.ReadAll(reply.Body)
+	if err != nil {
+		return "", err
+	}
+	var tokenResponse tokenReply
+	if err = json.Unmarshal(body, &tokenResponse); err != nil {
+		return "", err
+	}
+	credential, err := json.Marshal(linkCredential{
+		Instance:    link.Instance,
+		AccessToken: tokenResponse.AccessToken,
+	})
+	return string(credential), err
+}
+
+// Creates a client acting as the linked account. Its Eventloop is not meant to be run, notifications
+// of personal accounts are none of the bot's business.
+func (l Linker) Connect(credential string) (app.SocialAdapter, string, error) {
+	var link linkCredential
+	if err := json.Unmarshal([]byte(credential), &link); err != nil {
+		return nil, "", fmt.Errorf("Invalid link credential: %w", err)
+	}
+	if _, err := parseInstance(link.Instance); err != nil {
+		return nil, "", err
+	}
+	mc, err := New(link.Instance, "", "", link.AccessToken, "", "", l.database, l.client)
+	if err != nil {
+		return nil, "", err
+	}
+	return mc, mc.account.Account + "@" + mc.homeserver, nil
+}
@@ -11,6 +11,7 @@ import (
 	"log"
 	"net/http"
 	"net/url"
+	"slices"
 	"strings"
 	"time"
 
@@ -23,9 +24,25 @@ const create_table = `
     shorthand TEXT PRIMARY KEY,
     time DATETIME NOT NULL,
     tootid TEXT NOT NULL,
-    content TEXT NOT NULL
+    content TEXT NOT NULL,
+    account TEXT NOT NULL DEFAULT '',
+    dead INTEGER NOT NULL DEFAULT 0,
+    direct INTEGER NOT NULL DEFAULT 0
   );
 `
+// Databases created before several accounts were supported lack the account column.
+// Their messages (with an empty account) are treated as belonging to every account
+// The dead column marks deleted toots, the direct column direct messages, both added later as well
+var migrate_columns = map[string]string{
+	"account": `ALTER TABLE messages_mastodon ADD COLUMN account TEXT NOT NULL DEFAULT ''`,
+	"dead":    `ALTER TABLE messages_mastodon ADD COLUMN dead INTEGER NOT NULL DEFAULT 0`,
+	"direct":  `ALTER TABLE messages_mastodon ADD COLUMN direct INTEGER NOT NULL DEFAULT 0`,
+}
+
+// Number of bookmarks listed and length of the toot excerpts in lists
+const bookmark_list_length = 10
+const snippet_length = 80
+
 // exclude similar symbols (O and 0, I and l), but include some other quite unusual stuff for fun
 const base64mod = "ABCDEFGHJKLMNPQRSTUVWXYZabcdefghijkmnopqrstuvwxyz123456789.,;#!?"
 
@@ -34,11 +51,22 @@ type MastodonClient struct {
 	client              *http.Client
 	token               string
 	database            *sql.DB
+	// Host (and path prefix) of the instance, identifies it in messages and stored toots
 	homeserver          string
+	baseurl             *url.URL
 	account             *account
+	instance            *instance
+	// Whether our token has admin scopes
+	admin   bool
+	filters *filterCache
+	// Whether the Eventloop polls notifications and relays them, see SetNotificationRelay
+	relay bool
 }
 
 func (mc MastodonClient) Send(message string) (string, error) {
+	if err := mc.checkLength(message); err != nil {
+		return "", err
+	}
 	body := url.Values{
 		"status":     {message},
 		"visibility": {"unlisted"},
@@ -54,28 +82,68 @@ func (mc MastodonClient) Reply(shorthand string, message string) (string, error)
 		return "", fmt.Errorf("Could not reply to: %s", shorthand)
 	}
 
+	visibility := "unlisted"
+	if toot.Visibility == "direct" {
+		// Replies to direct messages stay direct. They only reach the author and everyone else in the
+		// conversation when mentioned
+		visibility = "direct"
+		accounts := []string{toot.Account.Account}
+		for _, mentioned := range toot.Mentions {
+			accounts = append(accounts, mentioned.Account)
+		}
+		var mentions []string
+		for _, account := range accounts {
+			mention := "@" + account
+			if account == mc.account.Account || strings.Contains(message, mention) || slices.Contains(mentions, mention) {
+				continue
+			}
+			mentions = append(mentions, mention)
+		}
+		if len(mentions) > 0 {
+			message = strings.Join(mentions, " ") + " " + message
+		}
+	}
+	if err := mc.checkLength(message); err != nil {
+		return "", err
+	}
 	body := url.Values{
-		"status":     {message},
-		"visibility": {"unlisted"},
-		//"visibility":     {"private"},
+		"status":         {message},
+		"visibility":     {visibility},
 		"in_reply_to_id": {toot.Id},
 	}
 	return mc.postStatus(body)
 }
 
+// Sends a direct message to an account (user@instance for remote accounts)
+func (mc MastodonClient) SendTo(target string, message string) (string, error) {
+	message = fmt.Sprintf("@%s %s", strings.TrimPrefix(target, "@"), message)
+	if err := mc.checkLength(message); err != nil {
+		return "", err
+	}
+	body := url.Values{
+		"status":     {message},
+		"visibility": {"direct"},
+	}
+	return mc.postStatus(body)
+}
+
 func (mc MastodonClient) lookupShorthand(messageID string) (*status, error) {
-	row := mc.database.QueryRow("SELECT tootid FROM messages_mastodon WHERE shorthand=?;", messageID)
+	row := mc.database.QueryRow("SELECT tootid, dead FROM messages_mastodon WHERE shorthand=? AND (account=? OR account='');", messageID, mc.owner())
 	var tootId string
-	err := row.Scan(&tootId)
+	var dead bool
+	err := row.Scan(&tootId, &dead)
 	if err != nil || tootId == "" {
 		return nil, fmt.Errorf("Toot not found in database: %s", messageID)
 	}
+	if dead {
+		return nil, fmt.Errorf("Toot %s was deleted", messageID)
+	}
 	toot, err := mc.getStatus(tootId)
-	if err != nil && err.Error() == "404" {
-		// If this happens the toot is not (most likely: no longer) existing
-		// subsequently we can delete our entry about it
-		mc.database.Query("DELETE FROM messages_mastodon WHERE shorthand=?;", messageID)
-		return nil, fmt.Errorf("Toot not found (404)")
+	if isGone(err) {
+		// If this happens the toot is not (most likely: no longer) existing,
+		// the deletion check just did not notice yet
+		mc.markDead(messageID)
+		return nil, fmt.Errorf("Toot %s was deleted", messageID)
 	}
 	return toot, err
 }
@@ -85,17 +153,65 @@ func (mc MastodonClient) GetMessage(messageID string) (string, error) {
 	if err != nil {
 		return "", fmt.Errorf("Error retrieving Toot: %w", err)
 	}
-  p := bluemonday.StrictPolicy()
-	plainContent := p.Sanitize( strings.TrimRight(strings.ReplaceAll(toot.Content, "</p>", "</p>\n"), "\n"))
-  unescapedContent := html.UnescapeString(plainContent)
-	indentedContent := "> " + strings.Join(strings.Split(unescapedContent, "\n"), "\n> ")
+	indentedContent := "> " + strings.Join(strings.Split(plainText(toot.Content), "\n"), "\n> ")
   for i, media := range toot.Attachments {
     indentedContent += fmt.Sprintf("\n Attachment %d: %s", i+1, media.Url)
   }
+	if toot.Poll != nil {
+		indentedContent += "\n" + formatPoll(toot.Poll)
+	}
 	output := fmt.Sprintf("[%s] Toot by: %s (%s)\n%s\n%s", messageID, toot.Account.DisplayName, toot.Account.Username, indentedContent, toot.Url)
 	return output, err
 }
 
+// Returns the account (user@instance for remote accounts) which wrote the toot
+func (mc MastodonClient) Author(messageID string) (string, error) {
+	toot, err := mc.lookupShorthand(messageID)
+	if err != nil {
+		return "", err
+	}
+	return toot.Account.Account, nil
+}
+
+// Converts the HTML content of a toot to plain text, paragraphs are kept as lines
+func plainText(content string) string {
+	p := bluemonday.StrictPolicy()
+	plainContent := p.Sanitize(strings.TrimRight(strings.ReplaceAll(content, "</p>", "</p>\n"), "\n"))
+	return html.UnescapeString(plainContent)
+}
+
+// Shortens the plain text of a toot to a single line of at most maxlen runes
+func snippet(content string, maxlen int) string {
+	text := []rune(strings.Join(strings.Fields(plainText(content)), " "))
+	if len(text) <= maxlen {
+		return string(text)
+	}
+	return string(text[:maxlen-1]) + "…"
+}
+
+func (mc MastodonClient) Summary(messageID string) (string, error) {
+	toot, err := mc.lookupShorthand(messageID)
+	if err != nil {
+		return "", err
+	}
+	return snippet(toot.Content, snippet_length), nil
+}
+
+// Toot authors are authenticated by their instance, so the account is just the author
+func (mc MastodonClient) Account(messageID string) (string, error) {
+	return mc.Author(messageID)
+}
+
+// The origin of a toot is its author, the one to talk to for a direct reply
+func (mc MastodonClient) Origin(messageID string) (string, error) {
+	return mc.Author(messageID)
+}
+
+// Describes the server we are connected to
+func (mc MastodonClient) Status() string {
+	return fmt.Sprintf("%s on %s: %s", mc.account.Account, mc.homeserver, mc.instance.describe())
+}
+
 // This calls a toggle for boosting, i.e. if already boosted this un-boosts. Currently defaults to "public" reblogs of toots.
 func (mc MastodonClient) Boost(messageID string) (bool, error) {
 	toot, err := mc.lookupShorthand(messageID)
@@ -120,9 +236,81 @@ func (mc MastodonClient) Favorite(messageID string) (bool, error) {
 	}
 }
 
+// Toggles bookmarking a toot.
+func (mc MastodonClient) Bookmark(messageID string) (bool, error) {
+	if err := mc.require(featureBookmarks); err != nil {
+		return false, err
+	}
+	toot, err := mc.lookupShorthand(messageID)
+	if err != nil {
+		return false, err
+	}
+	toot, err = mc.toggleTootBookmark(toot)
+	if err != nil {
+		return false, err
+	}
+	return toot.Bookmarked, nil
+}
+
+// Toggles pinning a toot to our profile. Only our own toots can be pinned.
+func (mc MastodonClient) Pin(messageID string) (bool, error) {
+	if err := mc.require(featurePins); err != nil {
+		return false, err
+	}
+	toot, err := mc.lookupShorthand(messageID)
+	if err != nil {
+		return false, err
+	}
+	if toot.Account.Account != mc.account.Account {
+		return false, fmt.Errorf("%s is not our toot, only our own toots can be pinned", messageID)
+	}
+	toot, err = mc.toggleTootPin(toot)
+	if err != nil {
+		return false, err
+	}
+	return toot.Pinned, nil
+}
+
+// Lists the latest bookmarks, one line per toot starting with its shorthand
+func (mc MastodonClient) Bookmarks() ([]string, error) {
+	if err := mc.require(featureBookmarks); err != nil {
+		return nil, err
+	}
+	bookmarks, err := mc.getBookmarks(bookmark_list_length)
+	if err != nil {
+		return nil, err
+	}
+	var lines []string
+	for _, toot := range *bookmarks {
+		if toot.Visibility == "direct" {
+			// The list is shown in the channel
+			continue
+		}
+		shorthand, err := mc.storeMessage(toot)
+		if err != nil {
+			return nil, fmt.Errorf("Error during storing bookmarked toot: %w", err)
+		}
+		lines = append(lines, fmt.Sprintf("[%s] %s: %s", shorthand, toot.Account.Account, snippet(toot.Content, snippet_length)))
+	}
+	return lines, nil
+}
+
 func (mc MastodonClient) Search(context string) (string, error) {
 	// search for context in mastodon, return first related toot
-	search, err := mc.search(context)
+	shorthand, err := mc.Resolve(context)
+	if err != nil {
+		return "", err
+	}
+	if mc.IsDirect(shorthand) {
+		// The result is shown where it was searched for, which is no place for direct messages
+		return "", fmt.Errorf("The toot is a direct message")
+	}
+	return mc.GetMessage(shorthand)
+}
+
+// Loads the toot behind a link via our instance and returns its shorthand
+func (mc MastodonClient) Resolve(link string) (string, error) {
+	search, err := mc.search(link)
 	if err != nil {
 		return "", err
 	}
@@ -133,7 +321,38 @@ func (mc MastodonClient) Search(context string) (string, error) {
 	if err != nil {
 		return "", fmt.Errorf("Error during storing found toot: %w", err)
 	}
-	return mc.GetMessage(shorthand)
+	return shorthand, nil
+}
+
+// Returns the permanent link of a toot, which other accounts can Resolve
+func (mc MastodonClient) Link(messageID string) (string, error) {
+	toot, err := mc.lookupShorthand(messageID)
+	if err != nil {
+		return "", err
+	}
+	if toot.Url == "" {
+		return toot.Uri, nil
+	}
+	return toot.Url, nil
+}
+
+// Checks if the shorthand was stored by this account
+func (mc MastodonClient) HasMessage(messageID string) bool {
+	row := mc.database.QueryRow("SELECT tootid FROM messages_mastodon WHERE shorthand=? AND (account=? OR account='');", messageID, mc.owner())
+	var tootId string
+	return row.Scan(&tootId) == nil
+}
+
+// Checks if the shorthand belongs to a toot with direct visibility
+func (mc MastodonClient) IsDirect(messageID string) bool {
+	row := mc.database.QueryRow("SELECT direct FROM messages_mastodon WHERE shorthand=? AND (account=? OR account='');", messageID, mc.owner())
+	var direct bool
+	return row.Scan(&direct) == nil && direct
+}
+
+// Identifies our account across instances, used to keep the stored messages of several accounts apart
+func (mc MastodonClient) owner() string {
+	return mc.account.Account + "@" + mc.homeserver
 }
 
 func encodeId(id string) string {
@@ -155,26 +374,41 @@ func (mc MastodonClient) Delete(messageID string) error {
 	if err != nil {
 		return err
 	}
-	mc.database.Query("DELETE FROM messages_mastodon WHERE shorthand=?;", messageID)
+	mc.markDead(messageID)
 	return err
 }
 
-func (mc MastodonClient) RegisterMessageHandler(handler app.MessageHandler) {
+func (mc *MastodonClient) RegisterMessageHandler(handler app.MessageHandler) {
 	mc.notificationHandler = handler
 }
 
+// Enables the notification relay: the Eventloop polls the notifications, hands them to the registered handler
+// and dismisses them on the server afterwards. Disabled (the default) the Eventloop returns right away.
+// Needs to be called before the Eventloop is started.
+func (mc *MastodonClient) SetNotificationRelay(enabled bool) {
+	mc.relay = enabled
+}
+
 // This eventloop performs 2 tasks, one visibile in code and one is a pure (wanted) side effect
 // First we request every 15 seconds from mastodon if we have new notifications
 // If so these are given to the notificationHandler with a bit of an unusual use of the parameters:
 // - mention and status notifications set the type according to their names, use the message as the reformatted status and provide the shorthand as mesasgeId
-// - reblog and favourite don't need to show the full toot, so message is the user who performed the action and messageId is the URL of the toot
+// - direct messages arrive as "direct" via their conversations, formatted like mentions (see relayConversations).
+//   Servers without conversations hand them over as direct mentions, relayed as "direct" as well
+// - poll notifications provide the formatted results of the ended poll as message and the shorthand as messageId
+// - update (an edited toot) provides the edit as diff against the stored content, delete (found by checkDeletions) the dead key's old text,
+//   both with the shorthand as messageId
+// - admin.sign_up and admin.report (only with admin scopes) provide a description as message and the account or report id as messageId
+// - reblog and favourite don't need to show the full toot, so message is the user who performed the action and messageId is the shorthand of the toot
+// - moin (a favourite of a toot saying just moin) provides the account as message and the URL of the toot as messageId
 //
 // The second use is to remind the mastodon server that we still exsist. Since mastodon bearer tokens do not have an expiration date, we want to make sure we're still known
 // otherwise our token might be invalidated at some point.
 func (mc MastodonClient) Eventloop() {
 	log.Println("Masotdon Adapter Loop started")
-	active := false
+	active := mc.relay
 	timeoffset, _ := time.ParseDuration("15s")
+	round := 1
 	for active {
 		nots, err := mc.getNotifications()
 		if err != nil {
@@ -184,6 +418,16 @@ func (mc MastodonClient) Eventloop() {
 			for _, value := range notifications {
 				switch value.Type {
 				case "mention":
+					msgtype := "mention"
+					if value.Status.Visibility == "direct" {
+						if mc.instance.Features[featureConversations] {
+							// Direct messages are relayed via their conversation (see relayConversations), never as public mentions.
+							// The notification is dismissed nonetheless
+							break
+						}
+						// Without conversations the mention is the only way to learn about the direct message
+						msgtype = "direct"
+					}
 					shorthand, err := mc.storeMessage(value.Status)
 					if err != nil {
 						log.Println("Error storing message:", err.Error())
@@ -194,7 +438,7 @@ func (mc MastodonClient) Eventloop() {
 						log.Println("Error getting message:", err.Error())
 						continue
 					}
-					mc.notificationHandler("mention", formatted, shorthand)
+					mc.notificationHandler(msgtype, formatted, shorthand)
 				case "status":
 					shorthand, err := mc.storeMessage(value.Status)
 					if err != nil {
@@ -207,13 +451,46 @@ func (mc MastodonClient) Eventloop() {
 						continue
 					}
 					mc.notificationHandler("status", formatted, shorthand)
-				case "reblog":
-					mc.notificationHandler("reblog", value.Account.DisplayName, value.Status.Url)
-				case "favourite":
-					if value.Status.Content == "<p>moin</p>" {
+				case "update":
+					// A toot we interacted with was edited
+					message, shorthand, err := mc.handleUpdate(value.Status)
+					if err != nil {
+						log.Println("Error handling edit:", err.Error())
+						continue
+					}
+					if message != "" {
+						mc.notificationHandler("update", message, shorthand)
+					}
+				case "poll":
+					// A poll we voted in or created has ended
+					shorthand, err := mc.storeMessage(value.Status)
+					if err != nil {
+						log.Println("Error storing message:", err.Error())
+						continue
+					}
+					if value.Status.Poll == nil {
+						log.Println("Poll notification without poll:", value.Id)
+					} else {
+						mc.notificationHandler("poll", formatPollResults(shorthand, value.Status.Poll), shorthand)
+					}
+				case "reblog", "favourite":
+					if value.Type == "favourite" && value.Status.Content == "<p>moin</p>" {
 						mc.notificationHandler("moin", value.Account.Account, value.Status.Url)
+						break
+					}
+					shorthand, err := mc.storeMessage(value.Status)
+					if err != nil {
+						log.Println("Error storing message:", err.Error())
+						continue
+					}
+					mc.notificationHandler(value.Type, value.Account.DisplayName, shorthand)
+				case "admin.sign_up":
+					mc.notificationHandler("admin.sign_up", formatSignUp(value.Account), value.Account.Id)
+				case "admin.report":
+					if value.Report == nil {
+						log.Println("Report notification without report:", value.Id)
 					} else {
-						mc.notificationHandler("favourite", value.Account.DisplayName, value.Status.Url)
+						mc.notificationHandler("admin.report", formatReport(*value.Report), value.Report.Id)
 					}
 				default:
 					continue // If it's a notification we can't handle we also don't want to dismiss it
@@ -223,15 +500,59 @@ func (mc MastodonClient) Eventloop() {
 				}
 			}
 		}
+		if mc.instance.Features[featureConversations] {
+			mc.relayConversations()
+		}
+		if round%deletion_check_rounds == 0 {
+			mc.checkDeletions()
+		}
+		round++
 		time.Sleep(timeoffset)
 	}
 }
 
+// Hands unread direct conversations to the notificationHandler as "direct" with the formatted latest status as message
+// and its shorthand as messageId. Afterwards the conversation is marked as read.
+func (mc MastodonClient) relayConversations() {
+	conversations, err := mc.getConversations()
+	if err != nil {
+		log.Println("Error getting conversations:", err)
+		return
+	}
+	for _, conv := range *conversations {
+		if !conv.Unread || conv.LastStatus == nil {
+			continue
+		}
+		if conv.LastStatus.Account.Account == mc.account.Account {
+			// Our own reply, nothing new to relay
+			mc.markConversationRead(conv)
+			continue
+		}
+		shorthand, err := mc.storeMessage(*conv.LastStatus)
+		if err != nil {
+			log.Println("Error storing message:", err.Error())
+			continue
+		}
+		formatted, err := mc.GetMessage(shorthand)
+		if err != nil {
+			log.Println("Error getting message:", err.Error())
+			continue
+		}
+		mc.notificationHandler("direct", formatted, shorthand)
+		if err = mc.markConversationRead(conv); err != nil {
+			log.Println("Error marking conversation as read:", err.Error())
+		}
+	}
+}
+
+// Stores a toot and returns its shorthand. Since status IDs are only unique per instance (and the same toot might be
+// stored by several of our accounts) the shorthand is derived from our account and the status ID.
 func (mc MastodonClient) storeMessage(message status) (string, error) {
-	shorthand := encodeId(message.Id)
-	_, err := mc.database.Exec("INSERT INTO messages_mastodon VALUES(?,?,?,?);", shorthand, time.Now(), message.Id, message.Content)
+	shorthand := encodeId(mc.owner() + "/" + message.Id)
+	direct := message.Visibility == "direct"
+	_, err := mc.database.Exec("INSERT INTO messages_mastodon(shorthand, time, tootid, content, account, dead, direct) VALUES(?,?,?,?,?,0,?);", shorthand, time.Now(), message.Id, message.Content, mc.owner(), direct)
 	if err != nil {
-		_, err := mc.database.Exec("UPDATE messages_mastodon SET time=?, tootid=?, content=? WHERE shorthand=?", time.Now(), message.Id, message.Content, shorthand)
+		_, err := mc.database.Exec("UPDATE messages_mastodon SET time=?, tootid=?, content=?, account=?, dead=0, direct=? WHERE shorthand=?", time.Now(), message.Id, message.Content, mc.owner(), direct, shorthand)
 		if err != nil {
 			return "", fmt.Errorf("Error during inserting message in database: %s", err)
 		}
@@ -239,21 +560,58 @@ func (mc MastodonClient) storeMessage(message status) (string, error) {
 	return shorthand, nil
 }
 
-func New(homeserver string, client_id string, client_secret string, access_token string, username string, password string, database *sql.DB) (*MastodonClient, error) {
+// Brings tables created by older versions up to date
+func migrate(database *sql.DB) error {
+	rows, err := database.Query("SELECT name FROM pragma_table_info('messages_mastodon');")
+	if err != nil {
+		return err
+	}
+	existing := make(map[string]bool)
+	for rows.Next() {
+		var column string
+		if err := rows.Scan(&column); err != nil {
+			rows.Close()
+			return err
+		}
+		existing[column] = true
+	}
+	rows.Close()
+	for column, statement := range migrate_columns {
+		if existing[column] {
+			continue
+		}
+		if _, err = database.Exec(statement); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Creates a client for the account on the instance at baseurl (see parseBaseURL for the accepted formats).
+// All requests go through the given HTTP client (see NewHTTPClient), nil uses a default client.
+func New(baseurl string, client_id string, client_secret string, access_token string, username string, password string, database *sql.DB, client *http.Client) (*MastodonClient, error) {
 	if _, err := database.Exec(create_table); err != nil {
 		return nil, err
 	}
+	if err := migrate(database); err != nil {
+		return nil, err
+	}
 
 	log.Println("Initializing Mastodon Bot")
 
-	client := &http.Client{}
+	base, err := parseBaseURL(baseurl)
+	if err != nil {
+		return nil, err
+	}
+	if client == nil {
+		client = &http.Client{}
+	}
 	var reply *http.Response
-	var err error
 	if len(access_token) == 0 {
 		log.Println("No Access Token provided. Trying to login with client and user credentials")
 		if len(client_id) == 0 || len(client_secret) == 0 {
 			log.Println("No Client ID provided. Generating new one.")
-			reply, err := client.PostForm(fmt.Sprintf(`https://%s/api/v1/apps`, homeserver), url.Values{
+			reply, err := client.PostForm(endpoint(base, `/api/v1/apps`), url.Values{
 				"client_name":   {"LetsGoTroet"},
 				"redirect_uris": {"urn:ietf:wg:oauth:2.0:oob"},
 				"scopes":        {"read write push"},
@@ -282,7 +640,7 @@ func New(homeserver string, client_id string, client_secret string, access_token
 			// TODO: Assume client id does OOB and do oauth. In this Case the client needs to be created in the app (based on input from IRC).
 			return nil, fmt.Errorf("Neither Access Token, nor Credentials provided. Please do out of band OAuth manually for now")
 		}
-		reply, err = client.PostForm(fmt.Sprintf(`https://%s/oauth/token`, homeserver), url.Values{
+		reply, err = client.PostForm(endpoint(base, `/oauth/token`), url.Values{
 			"client_id":     {client_id},
 			"client_secret": {client_secret},
 			"username":      {username},
@@ -312,12 +670,18 @@ func New(homeserver string, client_id string, client_secret string, access_token
 		token:               access_token,
 		client:              client,
 		database:            database,
-		homeserver:          homeserver,
+		homeserver:          base.Host + base.Path,
+		baseurl:             base,
+		filters:             &filterCache{},
 	}
 	acc, err := mc.getOwnAccount()
 	if err != nil {
 		return nil, fmt.Errorf("Unable to get account: %w", err)
 	}
 	mc.account = acc
+	mc.instance = mc.discoverInstance()
+	if mc.admin = mc.detectAdmin(); mc.admin {
+		log.Println("Token has admin scopes, relaying sign ups and reports")
+	}
 	return &mc, err
 }
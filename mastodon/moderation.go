@@ -0,0 +1,94 @@
+package mastodon
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// Reports a toot (and its author) to the moderators of our instance. With forward the report
+// is also sent to the moderators of the author's instance.
+func (mc MastodonClient) Report(messageID string, comment string, forward bool) error {
+	toot, err := mc.lookupShorthand(messageID)
+	if err != nil {
+		return err
+	}
+	if toot.Account.Account == mc.account.Account {
+		return fmt.Errorf("%s is our own toot", messageID)
+	}
+	body := url.Values{
+		"account_id":   {toot.Account.Id},
+		"status_ids[]": {toot.Id},
+		"comment":      {comment},
+		"forward":      {strconv.FormatBool(forward)},
+	}
+	request, err := http.NewRequest("POST", mc.endpoint(`/api/v1/reports`), strings.NewReader(body.Encode()))
+	if err != nil {
+		return fmt.Errorf("Error building request for report: %w", err)
+	}
+	if _, err = mc.executeRequest(request); err != nil {
+		return fmt.Errorf("Error during report request: %w", err)
+	}
+	return nil
+}
+
+// Returns the domain of the instance the author of the toot is on
+func (mc MastodonClient) Domain(messageID string) (string, error) {
+	toot, err := mc.lookupShorthand(messageID)
+	if err != nil {
+		return "", err
+	}
+	_, domain, remote := strings.Cut(toot.Account.Account, "@")
+	if !remote {
+		return "", fmt.Errorf("The author of %s is on our own instance", messageID)
+	}
+	return domain, nil
+}
+
+// Hides everything from a domain for our account
+func (mc MastodonClient) BlockDomain(domain string) error {
+	return mc.domainBlock("POST", domain)
+}
+
+func (mc MastodonClient) UnblockDomain(domain string) error {
+	return mc.domainBlock("DELETE", domain)
+}
+
+func (mc MastodonClient) DomainBlocks() ([]string, error) {
+	if err := mc.require(featureDomainBlocks); err != nil {
+		return nil, err
+	}
+	request, err := http.NewRequest("GET", mc.endpoint(`/api/v1/domain_blocks`), nil)
+	if err != nil {
+		return nil, fmt.Errorf("Error building request for domain blocks: %w", err)
+	}
+	respBody, err := mc.executeRequest(request)
+	if err != nil {
+		return nil, fmt.Errorf("Error during domain blocks request: %w", err)
+	}
+	var domains []string
+	if err = json.Unmarshal(respBody, &domains); err != nil {
+		return nil, fmt.Errorf("Error unmarshalling domain blocks: %w", err)
+	}
+	return domains, nil
+}
+
+func (mc MastodonClient) domainBlock(method string, domain string) error {
+	if err := mc.require(featureDomainBlocks); err != nil {
+		return err
+	}
+	body := url.Values{
+		"domain": {domain},
+	}
+	request, err := http.NewRequest(method, mc.endpoint(`/api/v1/domain_blocks`), strings.NewReader(body.Encode()))
+	if err != nil {
+		return fmt.Errorf("Error building request for domain block: %w", err)
+	}
+	if _, err = mc.executeRequest(request); err != nil {
+		return fmt.Errorf("Error during domain block request: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,147 @@
+package mastodon
+
+import (
+	"LetsGoTroet/app"
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+func (mc MastodonClient) SendPoll(message string, poll app.Poll) (string, error) {
+	if err := mc.require(featurePolls); err != nil {
+		return "", err
+	}
+	if err := mc.checkLength(message); err != nil {
+		return "", err
+	}
+	if err := mc.checkPoll(poll); err != nil {
+		return "", err
+	}
+	body := url.Values{
+		"status":           {message},
+		"visibility":       {"unlisted"},
+		"poll[options][]":  poll.Options,
+		"poll[expires_in]": {strconv.Itoa(int(poll.ExpiresIn.Seconds()))},
+		"poll[multiple]":   {strconv.FormatBool(poll.Multiple)},
+	}
+	return mc.postStatus(body)
+}
+
+func (mc MastodonClient) Vote(messageID string, choices []int) error {
+	if err := mc.require(featurePolls); err != nil {
+		return err
+	}
+	toot, err := mc.lookupShorthand(messageID)
+	if err != nil {
+		return err
+	}
+	if toot.Poll == nil {
+		return fmt.Errorf("%s has no poll", messageID)
+	}
+	if toot.Poll.Expired {
+		return fmt.Errorf("The poll of %s has already ended", messageID)
+	}
+	if len(choices) > 1 && !toot.Poll.Multiple {
+		return fmt.Errorf("The poll of %s only allows one choice", messageID)
+	}
+	for _, choice := range choices {
+		if choice >= len(toot.Poll.Options) {
+			return fmt.Errorf("The poll of %s only has %d options", messageID, len(toot.Poll.Options))
+		}
+	}
+	_, err = mc.votePoll(toot.Poll.Id, choices)
+	return err
+}
+
+// Checks a poll against the limits of the server
+func (mc MastodonClient) checkPoll(poll app.Poll) error {
+	limits := mc.instance
+	if limits.MaxPollOptions > 0 && len(poll.Options) > limits.MaxPollOptions {
+		return fmt.Errorf("Too many poll options, %s allows %d", mc.homeserver, limits.MaxPollOptions)
+	}
+	for _, option := range poll.Options {
+		if limits.MaxPollOptionChars > 0 && utf8.RuneCountInString(option) > limits.MaxPollOptionChars {
+			return fmt.Errorf("Poll option '%s' too long, %s allows %d characters", option, mc.homeserver, limits.MaxPollOptionChars)
+		}
+	}
+	seconds := int(poll.ExpiresIn.Seconds())
+	if limits.MinPollExpiration > 0 && seconds < limits.MinPollExpiration {
+		return fmt.Errorf("Poll duration too short, %s requires at least %s", mc.homeserver, time.Duration(limits.MinPollExpiration)*time.Second)
+	}
+	if limits.MaxPollExpiration > 0 && seconds > limits.MaxPollExpiration {
+		return fmt.Errorf("Poll duration too long, %s allows at most %s", mc.homeserver, time.Duration(limits.MaxPollExpiration)*time.Second)
+	}
+	return nil
+}
+
+// Renders the options of a poll (including results as far as they are known) for GetMessage
+func formatPoll(p *poll) string {
+	var lines []string
+	for i, option := range p.Options {
+		line := fmt.Sprintf(" %d. %s", i+1, option.Title)
+		if option.VotesCount != nil {
+			line += fmt.Sprintf(" (%s)", formatVotes(*option.VotesCount, pollTotal(p)))
+		}
+		lines = append(lines, line)
+	}
+	state := "open"
+	if p.Expired {
+		state = "closed"
+	} else if p.ExpiresAt != "" {
+		state = "open until " + p.ExpiresAt
+	}
+	kind := "Poll"
+	if p.Multiple {
+		kind = "Poll (multiple choice)"
+	}
+	return fmt.Sprintf("%s, %s:\n%s", kind, state, strings.Join(lines, "\n"))
+}
+
+// Renders the final results of a poll, including its winner(s)
+func formatPollResults(shorthand string, p *poll) string {
+	var lines []string
+	winners := []string{}
+	best := 0
+	for i, option := range p.Options {
+		votes := 0
+		if option.VotesCount != nil {
+			votes = *option.VotesCount
+		}
+		lines = append(lines, fmt.Sprintf(" %d. %s: %s", i+1, option.Title, formatVotes(votes, pollTotal(p))))
+		if votes > best {
+			best = votes
+			winners = []string{option.Title}
+		} else if votes == best && votes > 0 {
+			winners = append(winners, option.Title)
+		}
+	}
+	var result string
+	switch len(winners) {
+	case 0:
+		result = "Nobody voted"
+	case 1:
+		result = "Winner: " + winners[0]
+	default:
+		result = "Tie between: " + strings.Join(winners, ", ")
+	}
+	return fmt.Sprintf("[%s] Poll results (%d voters):\n%s\n%s", shorthand, p.VotersCount, strings.Join(lines, "\n"), result)
+}
+
+// Percentages of multiple choice polls are relative to the voters, like the Mastodon web interface does
+func pollTotal(p *poll) int {
+	if p.Multiple && p.VotersCount > 0 {
+		return p.VotersCount
+	}
+	return p.VotesCount
+}
+
+func formatVotes(votes int, total int) string {
+	percentage := 0.0
+	if total > 0 {
+		percentage = float64(votes) * 100 / float64(total)
+	}
+	return fmt.Sprintf("%d votes, %.1f%%", votes, percentage)
+}
@@ -0,0 +1,154 @@
+package mastodon
+
+import (
+	"LetsGoTroet/app"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/url"
+	"path"
+	"strconv"
+)
+
+// Used if the instance does not announce a limit for images
+const default_image_size_limit = 8 * 1024 * 1024
+
+func (mc MastodonClient) Profile() (app.Profile, error) {
+	creds, err := mc.getCredentials()
+	if err != nil {
+		return app.Profile{}, err
+	}
+	profile := app.Profile{
+		DisplayName: creds.DisplayName,
+		Note:        creds.Source.Note,
+		Avatar:      creds.Avatar,
+		Header:      creds.Header,
+	}
+	for _, field := range creds.Source.Fields {
+		profile.Fields = append(profile.Fields, app.ProfileField{Name: field.Name, Value: field.Value})
+	}
+	return profile, nil
+}
+
+// Updates the profile of our account. Only what differs from the current profile is sent,
+// avatar and header are downloaded from their URLs and uploaded to the instance.
+func (mc MastodonClient) UpdateProfile(profile app.Profile) error {
+	current, err := mc.Profile()
+	if err != nil {
+		return err
+	}
+	body := &bytes.Buffer{}
+	form := multipart.NewWriter(body)
+	if profile.DisplayName != current.DisplayName {
+		form.WriteField("display_name", profile.DisplayName)
+	}
+	if profile.Note != current.Note {
+		form.WriteField("note", profile.Note)
+	}
+	if !fieldsEqual(profile.Fields, current.Fields) {
+		for i, field := range profile.Fields {
+			form.WriteField(fmt.Sprintf("fields_attributes[%d][name]", i), field.Name)
+			form.WriteField(fmt.Sprintf("fields_attributes[%d][value]", i), field.Value)
+		}
+		// Fields not sent are kept by Mastodon, so remaining old fields are emptied
+		for i := len(profile.Fields); i < len(current.Fields); i++ {
+			form.WriteField(fmt.Sprintf("fields_attributes[%d][name]", i), "")
+			form.WriteField(fmt.Sprintf("fields_attributes[%d][value]", i), "")
+		}
+	}
+	images := map[string][2]string{
+		"avatar": {profile.Avatar, current.Avatar},
+		"header": {profile.Header, current.Header},
+	}
+	for name, image := range images {
+		if image[0] == image[1] || image[0] == "" {
+			continue
+		}
+		data, err := mc.download(image[0])
+		if err != nil {
+			return fmt.Errorf("Error downloading %s: %w", name, err)
+		}
+		part, err := form.CreateFormFile(name, path.Base(image[0]))
+		if err != nil {
+			return err
+		}
+		part.Write(data)
+	}
+	if err := form.Close(); err != nil {
+		return err
+	}
+	request, err := http.NewRequest("PATCH", mc.endpoint(`/api/v1/accounts/update_credentials`), body)
+	if err != nil {
+		return fmt.Errorf("Error building request for profile update: %w", err)
+	}
+	request.Header.Set("Content-Type", form.FormDataContentType())
+	if _, err = mc.executeRequest(request); err != nil {
+		return fmt.Errorf("Error during profile update request: %w", err)
+	}
+	return nil
+}
+
+func fieldsEqual(a []app.ProfileField, b []app.ProfileField) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// The link of a profile image comes from IRC, it is downloaded like the instances of linked accounts
+var image_client = newPublicClient()
+
+// Downloads an image for the profile, refusing anything larger than the instance accepts
+func (mc MastodonClient) download(link string) ([]byte, error) {
+	limit := default_image_size_limit
+	if mc.instance != nil && mc.instance.ImageSizeLimit > 0 {
+		limit = mc.instance.ImageSizeLimit
+	}
+	parsed, err := url.Parse(link)
+	if err != nil {
+		return nil, err
+	}
+	if err := checkPublicURL(parsed); err != nil {
+		return nil, fmt.Errorf("Refusing to download %s: %w", link, err)
+	}
+	resp, err := image_client.Get(parsed.String())
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != 200 {
+		return nil, fmt.Errorf("%d", resp.StatusCode)
+	}
+	data, err := io.ReadAll(io.LimitReader(resp.Body, int64(limit)+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(data) > limit {
+		return nil, fmt.Errorf("Image larger than the %s bytes %s accepts", strconv.Itoa(limit), mc.homeserver)
+	}
+	return data, nil
+}
+
+func (mc MastodonClient) getCredentials() (*credentialaccount, error) {
+	request, err := http.NewRequest("GET", mc.endpoint(`/api/v1/accounts/verify_credentials`), nil)
+	if err != nil {
+		return nil, fmt.Errorf("Error building request for credentials: %w", err)
+	}
+	respBody, err := mc.executeRequest(request)
+	if err != nil {
+		return nil, fmt.Errorf("Error during credentials request: %w", err)
+	}
+	var creds credentialaccount
+	if err = json.Unmarshal(respBody, &creds); err != nil {
+		return nil, fmt.Errorf("Error unmarshaling response %s , %w", string(respBody), err)
+	}
+	return &creds, nil
+}
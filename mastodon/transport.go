@@ -0,0 +1,72 @@
+package mastodon
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+)
+
+// Parses the base URL of an instance. Everything from a plain host name ("mastodon.social", https is assumed)
+// to full URLs with scheme, port and path prefix ("http://localhost:3000/mastodon") is accepted.
+func parseBaseURL(raw string) (*url.URL, error) {
+	if !strings.Contains(raw, "://") {
+		raw = "https://" + raw
+	}
+	base, err := url.Parse(raw)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid instance URL %s: %w", raw, err)
+	}
+	if base.Scheme != "https" && base.Scheme != "http" {
+		return nil, fmt.Errorf("Invalid instance URL %s: scheme must be http or https", raw)
+	}
+	if base.Host == "" {
+		return nil, fmt.Errorf("Invalid instance URL %s: no host", raw)
+	}
+	base.Path = strings.TrimSuffix(base.Path, "/")
+	base.RawQuery = ""
+	base.Fragment = ""
+	return base, nil
+}
+
+// Builds the URL of an API endpoint below the base URL. The path is a format string for the arguments.
+func endpoint(base *url.URL, path string, args ...any) string {
+	return base.String() + fmt.Sprintf(path, args...)
+}
+
+func (mc MastodonClient) endpoint(path string, args ...any) string {
+	return endpoint(mc.baseurl, path, args...)
+}
+
+// Creates the HTTP client used for all API requests. caFile optionally points to a PEM bundle of additional
+// certificate authorities (e.g. for a local test server), insecure disables certificate verification entirely
+// and is meant for development only.
+func NewHTTPClient(caFile string, insecure bool) (*http.Client, error) {
+	if caFile == "" && !insecure {
+		return &http.Client{}, nil
+	}
+	config := &tls.Config{}
+	if caFile != "" {
+		pem, err := os.ReadFile(caFile)
+		if err != nil {
+			return nil, fmt.Errorf("Could not read CA bundle: %w", err)
+		}
+		pool, err := x509.SystemCertPool()
+		if err != nil {
+			pool = x509.NewCertPool()
+		}
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("No certificates found in CA bundle %s", caFile)
+		}
+		config.RootCAs = pool
+	}
+	if insecure {
+		config.InsecureSkipVerify = true
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = config
+	return &http.Client{Transport: transport}, nil
+}
@@ -0,0 +1,57 @@
+package mastodon
+
+import "testing"
+
+func TestParseBaseURL(t *testing.T) {
+	tests := []struct {
+		name    string
+		raw     string
+		want    string
+		wantErr bool
+	}{
+		{"plain host", "mastodon.social", "https://mastodon.social", false},
+		{"https", "https://mastodon.social", "https://mastodon.social", false},
+		{"trailing slash", "https://mastodon.social/", "https://mastodon.social", false},
+		{"http with port", "http://localhost:3000", "http://localhost:3000", false},
+		{"host with port", "example.org:8443", "https://example.org:8443", false},
+		{"path prefix", "https://example.org/mastodon/", "https://example.org/mastodon", false},
+		{"query and fragment dropped", "https://example.org/mastodon?a=b#top", "https://example.org/mastodon", false},
+		{"other scheme", "ftp://example.org", "", true},
+		{"no host", "https://", "", true},
+		{"invalid", "https://exa mple.org", "", true},
+	}
+	for _, test := range tests {
+		got, err := parseBaseURL(test.raw)
+		if (err != nil) != test.wantErr {
+			t.Errorf("%s: parseBaseURL(%q) error = %v, want error %t", test.name, test.raw, err, test.wantErr)
+			continue
+		}
+		if err == nil && got.String() != test.want {
+			t.Errorf("%s: parseBaseURL(%q) = %q, want %q", test.name, test.raw, got.String(), test.want)
+		}
+	}
+}
+
+func TestEndpoint(t *testing.T) {
+	tests := []struct {
+		name string
+		base string
+		path string
+		args []any
+		want string
+	}{
+		{"plain host", "mastodon.social", "/api/v1/statuses/%s", []any{"42"}, "https://mastodon.social/api/v1/statuses/42"},
+		{"path prefix", "https://example.org/mastodon/", "/api/v1/instance", nil, "https://example.org/mastodon/api/v1/instance"},
+		{"port", "http://localhost:3000", "/oauth/token", nil, "http://localhost:3000/oauth/token"},
+	}
+	for _, test := range tests {
+		base, err := parseBaseURL(test.base)
+		if err != nil {
+			t.Errorf("%s: parseBaseURL(%q) failed: %v", test.name, test.base, err)
+			continue
+		}
+		if got := endpoint(base, test.path, test.args...); got != test.want {
+			t.Errorf("%s: endpoint(%q, %q) = %q, want %q", test.name, test.base, test.path, got, test.want)
+		}
+	}
+}
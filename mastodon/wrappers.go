@@ -6,9 +6,16 @@ import (
 	"io"
 	"net/http"
 	"net/url"
+	"strconv"
 	"strings"
 )
 
+// The notification types the Eventloop handles
+var notification_types = []string{"mention", "status", "reblog", "favourite", "poll", "update"}
+
+// Only requested with admin scopes
+var admin_notification_types = []string{"admin.sign_up", "admin.report"}
+
 type appsReply struct {
 	Id           string   `json:"id"`
 	Name         string   `json:"name"`
@@ -30,12 +37,44 @@ type tokenReply struct {
 type status struct {
 	Id          string            `json:"id"`
 	Content     string            `json:"content"`
+	SpoilerText string            `json:"spoiler_text"`
 	Url         string            `json:"url"`
+	Uri         string            `json:"uri"`
 	Account     account           `json:"account"`
 	Attachments []mediaattachment `json:"media_attachments"`
+	Mentions    []mention         `json:"mentions"`
 	ResponseTo  string            `json:"in_reply_to_id"`
+	Visibility  string            `json:"visibility"`
 	Reblogged   bool              `json:"reblogged"`
 	Favorited   bool              `json:"favourited"`
+	Bookmarked  bool              `json:"bookmarked"`
+	Pinned      bool              `json:"pinned"`
+	Poll        *poll             `json:"poll"`
+}
+
+type mention struct {
+	Id       string `json:"id"`
+	Username string `json:"username"`
+	Account  string `json:"acct"`
+	Url      string `json:"url"`
+}
+
+type poll struct {
+	Id          string       `json:"id"`
+	ExpiresAt   string       `json:"expires_at"`
+	Expired     bool         `json:"expired"`
+	Multiple    bool         `json:"multiple"`
+	VotesCount  int          `json:"votes_count"`
+	VotersCount int          `json:"voters_count"`
+	Options     []polloption `json:"options"`
+	Voted       bool         `json:"voted"`
+	OwnVotes    []int        `json:"own_votes"`
+}
+
+type polloption struct {
+	Title string `json:"title"`
+	// null if results are not published yet
+	VotesCount *int `json:"votes_count"`
 }
 
 type notification struct {
@@ -44,6 +83,23 @@ type notification struct {
 	CreatedAt string  `json:"created_at"`
 	Account   account `json:"account"`
 	Status    status  `json:"status"`
+	// Only set for admin.report notifications
+	Report *report `json:"report"`
+}
+
+type report struct {
+	Id            string   `json:"id"`
+	Category      string   `json:"category"`
+	Comment       string   `json:"comment"`
+	StatusIds     []string `json:"status_ids"`
+	TargetAccount account  `json:"target_account"`
+}
+
+type conversation struct {
+	Id         string    `json:"id"`
+	Unread     bool      `json:"unread"`
+	Accounts   []account `json:"accounts"`
+	LastStatus *status   `json:"last_status"`
 }
 
 type account struct {
@@ -53,6 +109,23 @@ type account struct {
 	DisplayName string `json:"display_name"`
 }
 
+// Returned by verify_credentials and update_credentials. The source contains the plain text
+// versions of note and fields which are meant for editing
+type credentialaccount struct {
+	account
+	Avatar string `json:"avatar"`
+	Header string `json:"header"`
+	Source struct {
+		Note   string         `json:"note"`
+		Fields []accountfield `json:"fields"`
+	} `json:"source"`
+}
+
+type accountfield struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+}
+
 type mediaattachment struct {
 	Id   string `json:"id"`
 	Type string `json:"type"`
@@ -65,9 +138,18 @@ type search struct {
 	// There also are hashtags. Currently not supported
 }
 
+// The status code of a failed request
+type httpError int
+
+func (e httpError) Error() string {
+	return strconv.Itoa(int(e))
+}
+
 func (mc MastodonClient) authorizedRequest(request *http.Request) *http.Request {
 	request.Header.Set("Authorization", fmt.Sprintf("Bearer %s", mc.token))
-	request.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	if request.Header.Get("Content-Type") == "" {
+		request.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	}
 	return request
 }
 
@@ -78,7 +160,7 @@ func (mc MastodonClient) executeRequest(request *http.Request) ([]byte, error) {
 		return nil, fmt.Errorf("Error in client.Do: %w", err)
 	}
 	if resp.StatusCode != 200 {
-		return nil, fmt.Errorf("%d", resp.StatusCode)
+		return nil, httpError(resp.StatusCode)
 	}
 	respBody, err := io.ReadAll(resp.Body)
 	if err != nil {
@@ -98,7 +180,7 @@ func (mc MastodonClient) toggleTootBoost(toot *status, visibility string) (*stat
 			"visibility": {visibility},
 		}
 	}
-	request, err := http.NewRequest("POST", fmt.Sprintf(`https://%s/api/v1/statuses/%s/%s`, mc.homeserver, toot.Id, action), strings.NewReader(body.Encode()))
+	request, err := http.NewRequest("POST", mc.endpoint(`/api/v1/statuses/%s/%s`, toot.Id, action), strings.NewReader(body.Encode()))
 	if err != nil {
 		return nil, fmt.Errorf("Error building request for boost: %w", err)
 	}
@@ -119,7 +201,7 @@ func (mc MastodonClient) toggleTootFave(toot *status) (*status, error) {
 		action = "un" + action
 	}
 	body := url.Values{}
-	request, err := http.NewRequest("POST", fmt.Sprintf(`https://%s/api/v1/statuses/%s/%s`, mc.homeserver, toot.Id, action), strings.NewReader(body.Encode()))
+	request, err := http.NewRequest("POST", mc.endpoint(`/api/v1/statuses/%s/%s`, toot.Id, action), strings.NewReader(body.Encode()))
 	if err != nil {
 		return nil, fmt.Errorf("Error building request for favouriting: %w", err)
 	}
@@ -134,8 +216,54 @@ func (mc MastodonClient) toggleTootFave(toot *status) (*status, error) {
 	return &updatedToot, nil
 }
 
+func (mc MastodonClient) toggleTootBookmark(toot *status) (*status, error) {
+	action := "bookmark"
+	if toot.Bookmarked {
+		action = "un" + action
+	}
+	return mc.statusAction(toot, action)
+}
+
+func (mc MastodonClient) toggleTootPin(toot *status) (*status, error) {
+	action := "pin"
+	if toot.Pinned {
+		action = "un" + action
+	}
+	return mc.statusAction(toot, action)
+}
+
+// Performs a POST on one of the parameterless actions of a status (e.g. bookmark, pin) and returns the updated status
+func (mc MastodonClient) statusAction(toot *status, action string) (*status, error) {
+	request, err := http.NewRequest("POST", mc.endpoint(`/api/v1/statuses/%s/%s`, toot.Id, action), strings.NewReader(""))
+	if err != nil {
+		return nil, fmt.Errorf("Error building request for %s: %w", action, err)
+	}
+	respBody, err := mc.executeRequest(request)
+	if err != nil {
+		return nil, fmt.Errorf("Error during %s request: %w", action, err)
+	}
+	var updatedToot status
+	if err = json.Unmarshal(respBody, &updatedToot); err != nil {
+		return nil, fmt.Errorf("Error unmarshaling %s response: %w", action, err)
+	}
+	return &updatedToot, nil
+}
+
+func (mc MastodonClient) getBookmarks(limit int) (*[]status, error) {
+	request, err := http.NewRequest("GET", mc.endpoint(`/api/v1/bookmarks?limit=%d`, limit), strings.NewReader(""))
+	respBody, err := mc.executeRequest(request)
+	if err != nil {
+		return nil, fmt.Errorf("Error during bookmarks request: %w", err)
+	}
+	var bookmarks []status
+	if err = json.Unmarshal(respBody, &bookmarks); err != nil {
+		return nil, fmt.Errorf("Error unmarshalling bookmarks response %s , %w", string(respBody), err)
+	}
+	return &bookmarks, nil
+}
+
 func (mc MastodonClient) deleteToot(toot *status) error {
-	request, err := http.NewRequest("DELETE", fmt.Sprintf(`https://%s/api/v1/statuses/%s`, mc.homeserver, toot.Id), strings.NewReader(""))
+	request, err := http.NewRequest("DELETE", mc.endpoint(`/api/v1/statuses/%s`, toot.Id), strings.NewReader(""))
 	// The request response is not used. It should be the deleted toot when the delete was successfull
 	_, err = mc.executeRequest(request)
 	if err != nil {
@@ -145,7 +273,7 @@ func (mc MastodonClient) deleteToot(toot *status) error {
 }
 
 func (mc MastodonClient) getStatus(tootId string) (*status, error) {
-	request, err := http.NewRequest("GET", fmt.Sprintf(`https://%s/api/v1/statuses/%s`, mc.homeserver, tootId), strings.NewReader(""))
+	request, err := http.NewRequest("GET", mc.endpoint(`/api/v1/statuses/%s`, tootId), strings.NewReader(""))
 	respBody, err := mc.executeRequest(request)
 	if err != nil {
 		return nil, fmt.Errorf("Error during status request: %w", err)
@@ -158,7 +286,20 @@ func (mc MastodonClient) getStatus(tootId string) (*status, error) {
 }
 
 func (mc MastodonClient) getNotifications() (*[]notification, error) {
-	request, err := http.NewRequest("GET", fmt.Sprintf(`https://%s/api/v1/notifications?types[]=mention&types[]=status&types[]=reblog&types[]=favourite`, mc.homeserver), strings.NewReader(""))
+	// Pleroma and Akkoma call the filter for notification types include_types
+	parameter := "types[]"
+	if mc.instance != nil && (mc.instance.Software == "pleroma" || mc.instance.Software == "akkoma") {
+		parameter = "include_types[]"
+	}
+	query := url.Values{}
+	types := notification_types
+	if mc.admin {
+		types = append(append([]string{}, types...), admin_notification_types...)
+	}
+	for _, notificationType := range types {
+		query.Add(parameter, notificationType)
+	}
+	request, err := http.NewRequest("GET", mc.endpoint(`/api/v1/notifications?%s`, query.Encode()), strings.NewReader(""))
 	respBody, err := mc.executeRequest(request)
 	if err != nil {
 		return nil, fmt.Errorf("Error during notification request: %w", err)
@@ -171,7 +312,7 @@ func (mc MastodonClient) getNotifications() (*[]notification, error) {
 }
 
 func (mc MastodonClient) dismissNotification(event notification) error {
-	request, err := http.NewRequest("GET", fmt.Sprintf(`https://%s/api/v1/notifications/%s/dismiss`, mc.homeserver, event.Id), strings.NewReader(""))
+	request, err := http.NewRequest("POST", mc.endpoint(`/api/v1/notifications/%s/dismiss`, event.Id), strings.NewReader(""))
 	_, err = mc.executeRequest(request)
 	if err != nil {
 		return fmt.Errorf("Error during dismiss notification request: %w", err)
@@ -179,9 +320,31 @@ func (mc MastodonClient) dismissNotification(event notification) error {
 	return nil
 }
 
+func (mc MastodonClient) getConversations() (*[]conversation, error) {
+	request, err := http.NewRequest("GET", mc.endpoint(`/api/v1/conversations`), strings.NewReader(""))
+	respBody, err := mc.executeRequest(request)
+	if err != nil {
+		return nil, fmt.Errorf("Error during conversations request: %w", err)
+	}
+	var conversations []conversation
+	if err = json.Unmarshal(respBody, &conversations); err != nil {
+		return nil, fmt.Errorf("Error unmarshalling conversations response %s , %w", string(respBody), err)
+	}
+	return &conversations, nil
+}
+
+func (mc MastodonClient) markConversationRead(conv conversation) error {
+	request, err := http.NewRequest("POST", mc.endpoint(`/api/v1/conversations/%s/read`, conv.Id), strings.NewReader(""))
+	_, err = mc.executeRequest(request)
+	if err != nil {
+		return fmt.Errorf("Error during conversation read request: %w", err)
+	}
+	return nil
+}
+
 func (mc MastodonClient) search(content string) (*search, error) {
 	encoded_content := url.QueryEscape(content)
-	url := fmt.Sprintf(`https://%s/api/v2/search?q=%s&resolve=true`, mc.homeserver, encoded_content)
+	url := mc.endpoint(`/api/v2/search?q=%s&resolve=true`, encoded_content)
 	request, err := http.NewRequest("GET", url, strings.NewReader(""))
 	if err != nil {
 		return nil, fmt.Errorf("Error building request for search: %w", err)
@@ -198,7 +361,7 @@ func (mc MastodonClient) search(content string) (*search, error) {
 }
 
 func (mc MastodonClient) postStatus(body url.Values) (string, error) {
-	request, err := http.NewRequest("POST", fmt.Sprintf(`https://%s/api/v1/statuses`, mc.homeserver), strings.NewReader(body.Encode()))
+	request, err := http.NewRequest("POST", mc.endpoint(`/api/v1/statuses`), strings.NewReader(body.Encode()))
 	respBody, err := mc.executeRequest(request)
 	if err != nil {
 		return "", fmt.Errorf("Error during status post request: %w", err)
@@ -210,10 +373,30 @@ func (mc MastodonClient) postStatus(body url.Values) (string, error) {
 	return mc.storeMessage(posted)
 }
 
+func (mc MastodonClient) votePoll(pollId string, choices []int) (*poll, error) {
+	body := url.Values{}
+	for _, choice := range choices {
+		body.Add("choices[]", strconv.Itoa(choice))
+	}
+	request, err := http.NewRequest("POST", mc.endpoint(`/api/v1/polls/%s/votes`, pollId), strings.NewReader(body.Encode()))
+	if err != nil {
+		return nil, fmt.Errorf("Error building request for vote: %w", err)
+	}
+	respBody, err := mc.executeRequest(request)
+	if err != nil {
+		return nil, fmt.Errorf("Error during vote request: %w", err)
+	}
+	var updatedPoll poll
+	if err = json.Unmarshal(respBody, &updatedPoll); err != nil {
+		return nil, fmt.Errorf("Error unmarshaling vote response: %w", err)
+	}
+	return &updatedPoll, nil
+}
+
 func (mc MastodonClient) getOwnAccount() (*account, error) {
 	// Be aware: This endpoint returns a CredentialAccount and *not* an Account.
 	// The CredentialAccount has additional fields, currently unused in this adapter: source and role
-	request, err := http.NewRequest("GET", fmt.Sprintf(`https://%s/api/v1/accounts/verify_credentials`, mc.homeserver), strings.NewReader(""))
+	request, err := http.NewRequest("GET", mc.endpoint(`/api/v1/accounts/verify_credentials`), strings.NewReader(""))
 	respBody, err := mc.executeRequest(request)
 	if err != nil {
 		return nil, fmt.Errorf("Error during own account request: %w", err)